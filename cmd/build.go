@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/linux-immutability-tools/EtcBuilder/core"
 	"github.com/spf13/cobra"
@@ -30,10 +32,105 @@ func NewBuildCommand() *cobra.Command {
 		SilenceUsage: true,
 	}
 
+	addMergeFlags(cmd)
+	cmd.Flags().Bool("strict-cleanup", false, "fail if unnecessary files can't be removed instead of warning")
+
 	return cmd
 }
 
-func buildCommand(_ *cobra.Command, args []string) error {
+// addMergeFlags adds the flags deciding how the user's files are merged with an update
+func addMergeFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("concurrency", 0, "maximum number of files processed in parallel, 0 uses one per CPU")
+	cmd.Flags().Bool("prefer-upstream-types", false, "replace modified user versions of paths whose type the update changed")
+	cmd.Flags().StringArray("exclude", []string{}, "handle files matching a pattern as volatile, given as pattern=skip|regenerate|always-keep")
+	cmd.Flags().String("policy", "", "file with per path rules, one \"pattern action\" per line")
+	cmd.Flags().StringArray("merge-rule", []string{}, "merge files matching a pattern with a strategy, given as pattern=strategy")
+	cmd.Flags().String("root", "", "root folder of the new system used to check that referenced files exist")
+	cmd.Flags().Bool("resolve-sidecars", false, "drop or merge .rpmnew, .dpkg-dist and .pacnew files instead of only reporting them")
+}
+
+// mergeOptionsFromFlags applies the flags added by addMergeFlags to options
+func mergeOptionsFromFlags(cmd *cobra.Command, options *core.BuildOptions) error {
+	concurrency, err := cmd.Flags().GetInt("concurrency")
+	if err != nil {
+		return err
+	}
+	options.Concurrency = concurrency
+
+	preferUpstreamTypes, err := cmd.Flags().GetBool("prefer-upstream-types")
+	if err != nil {
+		return err
+	}
+	if preferUpstreamTypes {
+		options.TypeChanges = core.TypeChangesPreferUpstream
+	}
+
+	mergeRules, err := cmd.Flags().GetStringArray("merge-rule")
+	if err != nil {
+		return err
+	}
+	for _, mergeRule := range mergeRules {
+		pattern, strategy, ok := strings.Cut(mergeRule, "=")
+		if !ok {
+			return fmt.Errorf("merge rule %s is not in the form pattern=strategy", mergeRule)
+		}
+
+		rule, err := core.NewMergeRule(pattern, strategy)
+		if err != nil {
+			return err
+		}
+		options.MergeRules = append(options.MergeRules, rule)
+	}
+
+	excludeRules, err := cmd.Flags().GetStringArray("exclude")
+	if err != nil {
+		return err
+	}
+	for _, excludeRule := range excludeRules {
+		pattern, categoryName, ok := strings.Cut(excludeRule, "=")
+		if !ok {
+			return fmt.Errorf("exclude rule %s is not in the form pattern=category", excludeRule)
+		}
+
+		category, err := core.ParseExcludeCategory(categoryName)
+		if err != nil {
+			return err
+		}
+
+		rule, err := core.NewExcludeRule(pattern, category)
+		if err != nil {
+			return err
+		}
+		options.ExcludeRules = append(options.ExcludeRules, rule)
+	}
+
+	root, err := cmd.Flags().GetString("root")
+	if err != nil {
+		return err
+	}
+	options.Root = root
+
+	resolveSidecars, err := cmd.Flags().GetBool("resolve-sidecars")
+	if err != nil {
+		return err
+	}
+	options.ResolveSidecars = resolveSidecars
+
+	policyFile, err := cmd.Flags().GetString("policy")
+	if err != nil {
+		return err
+	}
+	if policyFile != "" {
+		options.Policy, err = core.LoadPolicy(policyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func buildCommand(cmd *cobra.Command, args []string) error {
 	if len(args) <= 0 {
 		return fmt.Errorf("no etc directories specified")
 	} else if len(args) <= 3 {
@@ -45,7 +142,65 @@ func buildCommand(_ *cobra.Command, args []string) error {
 	oldUser := args[2]
 	newUser := args[3]
 
-	return ExtBuildCommand(oldSys, newSys, oldUser, newUser)
+	options := core.DefaultBuildOptions()
+
+	err := mergeOptionsFromFlags(cmd, &options)
+	if err != nil {
+		return err
+	}
+
+	strictCleanup, err := cmd.Flags().GetBool("strict-cleanup")
+	if err != nil {
+		return err
+	}
+	if strictCleanup {
+		options.CleanupErrors = core.CleanupErrorsFatal
+	}
+
+	report, err := ExtBuildCommandWithOptions(oldSys, newSys, oldUser, newUser, options)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range report.StaleShadows {
+		fmt.Println("dropped unmodified copy of:", path)
+	}
+
+	for _, path := range report.KeptStaleShadows {
+		fmt.Println("kept unmodified copy of:", path)
+	}
+
+	for _, typeChange := range report.TypeChanges {
+		if !typeChange.KeptUser {
+			fmt.Println("type change:", typeChange)
+		}
+	}
+
+	for _, path := range report.Regenerate {
+		fmt.Println("has to be regenerated:", path)
+	}
+
+	for _, path := range report.Merged {
+		fmt.Println("merged:", path)
+	}
+
+	for _, sidecar := range report.Sidecars {
+		fmt.Println("sidecar:", sidecar)
+	}
+
+	for _, conflict := range report.Conflicts {
+		fmt.Fprintln(os.Stderr, "Conflict:", conflict)
+	}
+
+	for _, symlink := range report.DanglingSymlinks {
+		fmt.Fprintln(os.Stderr, "Dangling symlink:", symlink)
+	}
+
+	for _, warning := range report.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
+
+	return nil
 }
 
 func ExtBuildCommand(oldSys, newSys, oldUser, newUser string) error {
@@ -57,3 +212,9 @@ func ExtBuildCommand(oldSys, newSys, oldUser, newUser string) error {
 
 	return nil
 }
+
+// ExtBuildCommandWithOptions builds the new etc like ExtBuildCommand but
+// returns warnings in the report instead of printing them
+func ExtBuildCommandWithOptions(oldSys, newSys, oldUser, newUser string, options core.BuildOptions) (*core.BuildReport, error) {
+	return core.BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, options)
+}
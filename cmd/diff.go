@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/linux-immutability-tools/EtcBuilder/core"
+	"github.com/spf13/cobra"
+)
+
+func NewDiffCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "diff <lower> <upper> [old-lower]",
+		Short:        "Show what the upper etc changes compared to the lower etc",
+		Args:         cobra.RangeArgs(2, 3),
+		RunE:         diffCommand,
+		SilenceUsage: true,
+	}
+
+	cmd.Flags().String("format", "text", "output format, text or json")
+
+	return cmd
+}
+
+func diffCommand(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown output format %s", format)
+	}
+
+	oldLower := ""
+	if len(args) == 3 {
+		oldLower = args[2]
+	}
+
+	diffs, err := core.DiffEtc(args[0], args[1], oldLower)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(diffs)
+	}
+
+	for _, diff := range diffs {
+		fmt.Printf("%s: %s\n", diff.Status, diff.Path)
+		fmt.Print(diff.Diff)
+	}
+
+	return nil
+}
@@ -11,6 +11,9 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(NewBuildCommand())
+	rootCmd.AddCommand(NewDiffCommand())
+	rootCmd.AddCommand(NewStatusCommand())
+	rootCmd.AddCommand(NewVerifyCommand())
 }
 
 func Execute() error {
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/linux-immutability-tools/EtcBuilder/core"
+	"github.com/spf13/cobra"
+)
+
+func NewStatusCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "status <old-lower> <new-lower> <upper>",
+		Short:        "Show what building a new etc would do with the user etc, without changing anything",
+		Args:         cobra.ExactArgs(3),
+		RunE:         statusCommand,
+		SilenceUsage: true,
+	}
+
+	addMergeFlags(cmd)
+
+	return cmd
+}
+
+func statusCommand(cmd *cobra.Command, args []string) error {
+	options := core.DefaultBuildOptions()
+
+	err := mergeOptionsFromFlags(cmd, &options)
+	if err != nil {
+		return err
+	}
+
+	preview, err := core.PreviewUpdate(args[0], args[1], args[2], options)
+	if err != nil {
+		return err
+	}
+
+	for _, conflict := range preview.Conflicts {
+		fmt.Println("conflict:", conflict)
+	}
+
+	for _, path := range preview.Merged {
+		fmt.Println("will be merged:", path)
+	}
+
+	for _, path := range preview.StaleShadows {
+		fmt.Println("will drop unmodified copy of:", path)
+	}
+
+	for _, path := range preview.KeptStaleShadows {
+		fmt.Println("will keep unmodified copy of:", path)
+	}
+
+	for _, typeChange := range preview.TypeChanges {
+		if !typeChange.KeptUser {
+			fmt.Println("type change:", typeChange)
+		}
+	}
+
+	for _, path := range preview.Regenerate {
+		fmt.Println("will have to be regenerated:", path)
+	}
+
+	for _, sidecar := range preview.Sidecars {
+		fmt.Println("sidecar:", sidecar)
+	}
+
+	for _, account := range preview.Accounts {
+		fmt.Println("account:", account)
+	}
+
+	for _, warning := range preview.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/linux-immutability-tools/EtcBuilder/core"
+	"github.com/spf13/cobra"
+)
+
+func NewVerifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "verify <lower> [upper]",
+		Short:        "Check a built etc for broken account files, permissions and owners",
+		Args:         cobra.RangeArgs(1, 2),
+		RunE:         verifyCommand,
+		SilenceUsage: true,
+	}
+
+	cmd.Flags().String("format", "text", "output format, text or json")
+
+	return cmd
+}
+
+func verifyCommand(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown output format %s", format)
+	}
+
+	upper := ""
+	if len(args) == 2 {
+		upper = args[1]
+	}
+
+	findings, err := core.VerifyEtc(args[0], upper)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(findings)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, finding := range findings {
+			fmt.Println(finding)
+		}
+	}
+
+	errorCount := 0
+	for _, finding := range findings {
+		if finding.Severity == core.SeverityError {
+			errorCount++
+		}
+	}
+	if errorCount != 0 {
+		return fmt.Errorf("found %d errors", errorCount)
+	}
+
+	return nil
+}
@@ -0,0 +1,353 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// ChangeKind describes how a path changed between the old lower etc,
+// the new lower etc and the upper etc
+type ChangeKind int
+
+const (
+	// ChangeUnchanged means neither the user nor the update changed the path,
+	// or both changed it to the same result
+	ChangeUnchanged ChangeKind = iota
+	// ChangeUserModified means the upper differs from the old lower and the update didn't change it
+	ChangeUserModified
+	// ChangeUpstreamModified means the update changed the path and the upper has no own version of it
+	ChangeUpstreamModified
+	// ChangeBothModified means the upper and the update both changed the path differently
+	ChangeBothModified
+	// ChangeUserAdded means the path only exists in the upper
+	ChangeUserAdded
+	// ChangeUpstreamAdded means the update added the path and the upper has no own version of it
+	ChangeUpstreamAdded
+	// ChangeBothAdded means the upper and the update both added the path with different versions
+	ChangeBothAdded
+	// ChangeUserDeleted means the upper contains a whiteout for the path
+	ChangeUserDeleted
+	// ChangeUpstreamDeleted means the update removed the path and the user didn't change it
+	ChangeUpstreamDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeUnchanged:
+		return "unchanged"
+	case ChangeUserModified:
+		return "user-modified"
+	case ChangeUpstreamModified:
+		return "upstream-modified"
+	case ChangeBothModified:
+		return "both-modified"
+	case ChangeUserAdded:
+		return "user-added"
+	case ChangeUpstreamAdded:
+		return "upstream-added"
+	case ChangeBothAdded:
+		return "both-added"
+	case ChangeUserDeleted:
+		return "user-deleted"
+	case ChangeUpstreamDeleted:
+		return "upstream-deleted"
+	default:
+		return fmt.Sprintf("ChangeKind(%d)", int(k))
+	}
+}
+
+// NodeType is the type of a path in one of the etc folders
+type NodeType int
+
+const (
+	// NodeMissing means the path doesn't exist
+	NodeMissing NodeType = iota
+	NodeRegularFile
+	NodeFolder
+	NodeSymlink
+	// NodeWhiteout is an overlayfs whiteout hiding the lower version
+	NodeWhiteout
+	NodeDevice
+	NodeOther
+)
+
+func (t NodeType) String() string {
+	switch t {
+	case NodeMissing:
+		return "missing"
+	case NodeRegularFile:
+		return "regular file"
+	case NodeFolder:
+		return "folder"
+	case NodeSymlink:
+		return "symlink"
+	case NodeWhiteout:
+		return "whiteout"
+	case NodeDevice:
+		return "device"
+	case NodeOther:
+		return "other"
+	default:
+		return fmt.Sprintf("NodeType(%d)", int(t))
+	}
+}
+
+func nodeTypeOf(info os.FileInfo) NodeType {
+	mode := info.Mode()
+
+	switch {
+	case mode.IsRegular():
+		return NodeRegularFile
+	case mode.IsDir():
+		return NodeFolder
+	case mode&os.ModeSymlink != 0:
+		return NodeSymlink
+	case isWhiteout(info):
+		return NodeWhiteout
+	case mode&os.ModeDevice != 0:
+		return NodeDevice
+	default:
+		return NodeOther
+	}
+}
+
+// PathChange is the classification of a single path relative to the etc folders
+type PathChange struct {
+	Path string
+	Kind ChangeKind
+
+	InLowerOld bool
+	InLowerNew bool
+	// InUpper is true if the upper contains its own version of the path,
+	// whiteouts count as well
+	InUpper bool
+	// UpperIsBase is true if the upper version is identical to the old lower one
+	UpperIsBase bool
+
+	OldType   NodeType
+	NewType   NodeType
+	UpperType NodeType
+}
+
+// IsStaleShadow checks if the upper version is an unmodified copy of the old
+// lower one while the update changed or removed it, so it only hides the update
+func (c PathChange) IsStaleShadow() bool {
+	return c.InUpper && c.UpperIsBase && (c.Kind == ChangeUpstreamModified || c.Kind == ChangeUpstreamDeleted)
+}
+
+// IsTypeChange checks if the update changed the type of the path,
+// like turning a regular file into a symlink
+func (c PathChange) IsTypeChange() bool {
+	return c.InLowerOld && c.InLowerNew && c.OldType != c.NewType
+}
+
+// MasksTypeChange checks if the update changed the type of the path
+// and the upper contains a version of another type that hides it
+func (c PathChange) MasksTypeChange() bool {
+	return c.IsTypeChange() && c.InUpper && c.UpperType != NodeWhiteout && c.UpperType != c.NewType
+}
+
+// ChangeSet contains the classification of all paths sorted by path
+type ChangeSet []PathChange
+
+// Get returns the classification of path
+func (c ChangeSet) Get(path string) (PathChange, bool) {
+	index, found := slices.BinarySearchFunc(c, path, func(change PathChange, path string) int {
+		return strings.Compare(change.Path, path)
+	})
+	if !found {
+		return PathChange{}, false
+	}
+
+	return c[index], true
+}
+
+// ClassifyChanges compares the upper etc and the new lower etc against the
+// old lower etc, which is the base both of them started from, and classifies
+// every path found in any of them.
+func ClassifyChanges(lowerOld, lowerNew, upper string) (ChangeSet, error) {
+	return classifyChanges(lowerOld, lowerNew, upper, 0, NewDigestCache(), nil)
+}
+
+// ownerMapping maps the uids and gids of the new lower to the ones they get in the new etc
+type ownerMapping struct {
+	users  map[int]int
+	groups map[int]int
+}
+
+// apply returns info with the owner the mapping gives it, symlinks keep
+// their owner like in applyOwnerMapping
+func (m *ownerMapping) apply(info os.FileInfo) os.FileInfo {
+	if m == nil || isSymlink(info) {
+		return info
+	}
+
+	stat := *info.Sys().(*syscall.Stat_t)
+	if uid, ok := m.users[int(stat.Uid)]; ok {
+		stat.Uid = uint32(uid)
+	}
+	if gid, ok := m.groups[int(stat.Gid)]; ok {
+		stat.Gid = uint32(gid)
+	}
+
+	return mappedInfo{FileInfo: info, stat: &stat}
+}
+
+// mappedInfo is a FileInfo with another owner
+type mappedInfo struct {
+	os.FileInfo
+	stat *syscall.Stat_t
+}
+
+func (i mappedInfo) Sys() any {
+	return i.stat
+}
+
+// classifyChanges classifies the paths like ClassifyChanges, the owners of the new lower
+// are compared as they are after applying mapping, which may be nil
+func classifyChanges(lowerOld, lowerNew, upper string, concurrency int, digests *DigestCache, mapping *ownerMapping) (ChangeSet, error) {
+	pathSet := make(map[string]bool)
+
+	for _, root := range []string{lowerOld, lowerNew, upper} {
+		entries, err := walkTree(root)
+		if err != nil {
+			return nil, fmt.Errorf("can't classify changes: %w", err)
+		}
+
+		for _, entry := range entries {
+			// the roots themselves are different folders by definition
+			if entry.path == "." {
+				continue
+			}
+			pathSet[entry.path] = true
+		}
+	}
+
+	paths := make([]string, 0, len(pathSet))
+	for path := range pathSet {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	changes := make(ChangeSet, len(paths))
+	errs := forEachParallel(len(paths), concurrency, func(i int) error {
+		change, err := classifyPath(paths[i], lowerOld, lowerNew, upper, digests, mapping)
+		if err != nil {
+			return fmt.Errorf("can't classify \"%s\": %w", paths[i], err)
+		}
+		changes[i] = change
+
+		return nil
+	})
+
+	err := firstError(errs)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func classifyPath(path, lowerOld, lowerNew, upper string, digests *DigestCache, mapping *ownerMapping) (PathChange, error) {
+	change := PathChange{Path: path}
+
+	oldPath := filepath.Join(lowerOld, path)
+	newPath := filepath.Join(lowerNew, path)
+	upperPath := filepath.Join(upper, path)
+
+	oldInfo, oldErr := os.Lstat(oldPath)
+	newInfo, newErr := os.Lstat(newPath)
+	upperInfo, upperErr := os.Lstat(upperPath)
+
+	change.InLowerOld = oldErr == nil
+	change.InLowerNew = newErr == nil
+	change.InUpper = upperErr == nil
+
+	if change.InLowerOld {
+		change.OldType = nodeTypeOf(oldInfo)
+	}
+	if change.InLowerNew {
+		change.NewType = nodeTypeOf(newInfo)
+		newInfo = mapping.apply(newInfo)
+	}
+	if change.InUpper {
+		change.UpperType = nodeTypeOf(upperInfo)
+	}
+
+	upstreamChanged := change.InLowerOld != change.InLowerNew
+	if change.InLowerOld && change.InLowerNew {
+		identical, err := nodesIdentical(path, oldInfo, newInfo, oldPath, newPath, digests)
+		if err != nil {
+			return change, err
+		}
+		upstreamChanged = !identical
+	}
+
+	if !change.InUpper {
+		switch {
+		case !upstreamChanged:
+			change.Kind = ChangeUnchanged
+		case !change.InLowerOld:
+			change.Kind = ChangeUpstreamAdded
+		case !change.InLowerNew:
+			change.Kind = ChangeUpstreamDeleted
+		default:
+			change.Kind = ChangeUpstreamModified
+		}
+
+		return change, nil
+	}
+
+	if isWhiteout(upperInfo) {
+		if change.InLowerOld && change.InLowerNew && upstreamChanged {
+			change.Kind = ChangeBothModified
+		} else {
+			change.Kind = ChangeUserDeleted
+		}
+
+		return change, nil
+	}
+
+	if change.InLowerOld {
+		identical, err := nodesIdentical(path, upperInfo, oldInfo, upperPath, oldPath, digests)
+		if err != nil {
+			return change, err
+		}
+		change.UpperIsBase = identical
+	}
+
+	// the user and the update may have made the same change
+	upperIsNew := false
+	if change.InLowerNew && !change.UpperIsBase {
+		identical, err := nodesIdentical(path, upperInfo, newInfo, upperPath, newPath, digests)
+		if err != nil {
+			return change, err
+		}
+		upperIsNew = identical
+	}
+
+	switch {
+	case upperIsNew:
+		change.Kind = ChangeUnchanged
+	case !change.InLowerOld && !change.InLowerNew:
+		change.Kind = ChangeUserAdded
+	case !change.InLowerOld:
+		change.Kind = ChangeBothAdded
+	case change.UpperIsBase && !upstreamChanged:
+		change.Kind = ChangeUnchanged
+	case change.UpperIsBase && !change.InLowerNew:
+		change.Kind = ChangeUpstreamDeleted
+	case change.UpperIsBase:
+		change.Kind = ChangeUpstreamModified
+	case !upstreamChanged:
+		change.Kind = ChangeUserModified
+	default:
+		change.Kind = ChangeBothModified
+	}
+
+	return change, nil
+}
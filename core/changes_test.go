@@ -0,0 +1,258 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyChanges(t *testing.T) {
+	dir := t.TempDir()
+	lowerOld := filepath.Join(dir, "lowerOld")
+	lowerNew := filepath.Join(dir, "lowerNew")
+	upper := filepath.Join(dir, "upper")
+
+	// contents of each path in the old lower, new lower and upper, "" means missing
+	files := map[string][3]string{
+		"unchanged":              {"a", "a", ""},
+		"unchanged copy":         {"a", "a", "a"},
+		"same change":            {"a", "b", "b"},
+		"user modified":          {"a", "a", "b"},
+		"upstream modified":      {"a", "b", ""},
+		"stale copy":             {"a", "b", "a"},
+		"both modified":          {"a", "b", "c"},
+		"user added":             {"", "", "a"},
+		"upstream added":         {"", "a", ""},
+		"both added":             {"", "a", "b"},
+		"upstream deleted":       {"a", "", ""},
+		"upstream deleted copy":  {"a", "", "a"},
+		"upstream deleted, user": {"a", "", "b"},
+	}
+	expect := map[string]ChangeKind{
+		"unchanged":              ChangeUnchanged,
+		"unchanged copy":         ChangeUnchanged,
+		"same change":            ChangeUnchanged,
+		"user modified":          ChangeUserModified,
+		"upstream modified":      ChangeUpstreamModified,
+		"stale copy":             ChangeUpstreamModified,
+		"both modified":          ChangeBothModified,
+		"user added":             ChangeUserAdded,
+		"upstream added":         ChangeUpstreamAdded,
+		"both added":             ChangeBothAdded,
+		"upstream deleted":       ChangeUpstreamDeleted,
+		"upstream deleted copy":  ChangeUpstreamDeleted,
+		"upstream deleted, user": ChangeBothModified,
+		"whiteout":               ChangeUserDeleted,
+		"whiteout, modified":     ChangeBothModified,
+	}
+
+	paths := map[string]string{}
+	for name, contents := range files {
+		for i, root := range []string{lowerOld, lowerNew, upper} {
+			if contents[i] != "" {
+				paths[filepath.Join(root, name)] = contents[i]
+			}
+		}
+	}
+	writeFiles(t, paths)
+
+	for name, contents := range map[string][2]string{"whiteout": {"a", "a"}, "whiteout, modified": {"a", "b"}} {
+		writeFiles(t, map[string]string{filepath.Join(lowerOld, name): contents[0], filepath.Join(lowerNew, name): contents[1]})
+
+		err := syscall.Mknod(filepath.Join(upper, name), syscall.S_IFCHR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := ClassifyChanges(lowerOld, lowerNew, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != len(expect) {
+		t.Errorf("%d paths classified instead of %d", len(changes), len(expect))
+	}
+
+	for name, kind := range expect {
+		change, ok := changes.Get(name)
+		if !ok {
+			t.Errorf("%s was not classified", name)
+			continue
+		}
+		if change.Kind != kind {
+			t.Errorf("%s classified as %s instead of %s", name, change.Kind, kind)
+		}
+	}
+}
+
+func TestUpstreamDeleted(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	for _, root := range []string{oldSys, oldUser} {
+		err := os.MkdirAll(filepath.Join(root, "removed.d"), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, "removed.d", "unmodified"), []byte("data"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, "modified"), []byte("data"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(oldUser, "modified"), []byte("user data"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = BuildNewEtc(oldSys, oldUser, newSys, newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Lstat(filepath.Join(newUser, "removed.d"))
+	if err == nil {
+		t.Error("unmodified copy of a removed folder was carried over")
+	}
+
+	_, err = os.Lstat(filepath.Join(newUser, "modified"))
+	if err != nil {
+		t.Error("modified copy of a removed file was not carried over")
+	}
+}
+
+func TestNoUpperAccounts(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	for _, file := range []string{"passwd", "group", "shadow", "gshadow", "shells"} {
+		err := os.Remove(filepath.Join(oldUser, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := BuildNewEtc(oldSys, oldUser, newSys, newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Lstat(filepath.Join(newUser, "passwd"))
+	if err == nil {
+		t.Error("passwd file was created even though the user never changed it")
+	}
+}
+
+func TestStaleShadows(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	for _, root := range []string{oldSys, oldUser} {
+		err := os.WriteFile(filepath.Join(root, "stale"), []byte("old data"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(newSys, "stale"), []byte("new data"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unmodified passwd must not bring back users the update removed
+	err = os.WriteFile(filepath.Join(oldUser, "passwd"), []byte(passwdLowerOld), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwdNew := strings.ReplaceAll(passwdLowerNew, "irc:x:39:39:ircd:/run/ircd:/usr/sbin/nologin\n", "")
+	err = os.WriteFile(filepath.Join(newSys, "passwd"), []byte(passwdNew), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unmodified folder the update changed is kept for the user's file in it
+	for _, root := range []string{oldSys, oldUser, newSys} {
+		err = os.Mkdir(filepath.Join(root, "conf.d"), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Chmod(filepath.Join(newSys, "conf.d"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(oldUser, "conf.d/mine.conf"), []byte("mine"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(report.StaleShadows, []string{"passwd", "stale"}) {
+		t.Errorf("reported stale shadows %v", report.StaleShadows)
+	}
+	if !slices.Equal(report.KeptStaleShadows, []string{"conf.d"}) {
+		t.Errorf("reported kept stale shadows %v", report.KeptStaleShadows)
+	}
+
+	info, err := os.Lstat(filepath.Join(newUser, "conf.d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Errorf("kept stale folder has mode %o instead of the new lower's", info.Mode().Perm())
+	}
+
+	for _, path := range []string{"passwd", "stale"} {
+		_, err = os.Lstat(filepath.Join(newUser, path))
+		if err == nil {
+			t.Errorf("stale copy of %s was not removed", path)
+		}
+	}
+}
+
+func TestClassifyRemappedOwner(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	// the update only gives chrony another gid, which the user's group file maps back
+	files := map[string]string{
+		filepath.Join(oldSys, "group"):        "root:x:0:\nchrony:x:1001:\n",
+		filepath.Join(newSys, "group"):        "root:x:0:\nchrony:x:990:\n",
+		filepath.Join(oldUser, "group"):       "root:x:0:\nchrony:x:1001:\nmine:x:1000:\n",
+		filepath.Join(oldSys, "chrony.conf"):  "server a\n",
+		filepath.Join(newSys, "chrony.conf"):  "server a\n",
+		filepath.Join(oldUser, "chrony.conf"): "server b\n",
+	}
+	writeFiles(t, files)
+	for root, gid := range map[string]int{oldSys: 1001, newSys: 990, oldUser: 1001} {
+		err := os.Chown(filepath.Join(root, "chrony.conf"), 0, gid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	preview, err := PreviewUpdate(oldSys, newSys, oldUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, changes := range map[string]ChangeSet{"preview": preview.Changes, "build": report.Changes} {
+		change, _ := changes.Get("chrony.conf")
+		if change.Kind != ChangeUserModified {
+			t.Errorf("%s classified chrony.conf as %s instead of %s", name, change.Kind, ChangeUserModified)
+		}
+	}
+	if len(preview.Conflicts) != 0 || len(report.Conflicts) != 0 {
+		t.Errorf("remapped gid is reported as conflict: %v %v", preview.Conflicts, report.Conflicts)
+	}
+}
@@ -2,7 +2,6 @@ package core
 
 import (
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
 )
@@ -12,60 +11,182 @@ type Comparable interface {
 	IsIdentical(a, b os.FileInfo, aPath, bPath string) (bool, error)
 }
 
-// no folders since checking if they are empty complicates things
-var comparables = [...]Comparable{&RegularFile{}, &Symlink{}, &CharDeviceFile{}}
+// CleanupError is a problem with a single path found during cleanup
+type CleanupError struct {
+	Path string
+	Err  error
+}
+
+func (e *CleanupError) Error() string {
+	return fmt.Sprintf("can't clean up \"%s\": %s", e.Path, e.Err)
+}
+
+func (e *CleanupError) Unwrap() error {
+	return e.Err
+}
+
+// ErrCleanupFiles collects all problems found during cleanup
+type ErrCleanupFiles struct {
+	errs []error
+}
+
+func (e *ErrCleanupFiles) Error() string {
+	return "can't clean up all files: " + fmt.Sprint(e.errs)
+}
+
+func (e *ErrCleanupFiles) Unwrap() []error {
+	return e.errs
+}
 
 // RemoveIdenticalFiles removes files from target if an identical
 // version exists in the same location in base.
-func RemoveIdenticalFiles(target string, base string) {
-	filesToRemove := []string{}
+//
+// Afterwards folders that are empty and have the same attributes as
+// the folder in base are removed as well, starting from the deepest one.
+//
+// Paths matching ExcludeRules are never compared and removed.
+//
+// Problems with single paths don't stop the cleanup, they are returned
+// together as *ErrCleanupFiles containing a *CleanupError for each path.
+func RemoveIdenticalFiles(target string, base string) error {
+	return removeIdenticalFiles(target, base, 0, isExcluded)
+}
 
-	err := fs.WalkDir(os.DirFS(target), ".", func(path string, d fs.DirEntry, err error) error {
+// removeIdenticalFiles works like RemoveIdenticalFiles, paths keep returns true for are never removed
+func removeIdenticalFiles(target, base string, concurrency int, keep func(path string) bool) error {
+	errs := []error{}
+
+	// paths that can't be searched are reported and left alone, the rest is still cleaned up
+	entries, _ := walkTreeWith(target, func(path string, err error) error {
+		errs = append(errs, &CleanupError{Path: path, Err: err})
+		return nil
+	})
+
+	files := []string{}
+	foldersToCheck := []string{}
+
+	for _, entry := range entries {
+		if keep != nil && keep(entry.path) {
+			continue
+		}
+
+		if !entry.entry.IsDir() {
+			files = append(files, entry.path)
+		} else if entry.path != "." {
+			foldersToCheck = append(foldersToCheck, entry.path)
+		}
+	}
+
+	identical := make([]bool, len(files))
+	compareErrs := forEachParallel(len(files), concurrency, func(i int) error {
+		isIdentical, err := isIdenticalFile(files[i], target, base)
+		identical[i] = isIdentical
+		return err
+	})
+
+	for i, path := range files {
+		if compareErrs[i] != nil {
+			errs = append(errs, &CleanupError{Path: path, Err: fmt.Errorf("can't compare: %w", compareErrs[i])})
+			continue
+		}
+		if !identical[i] {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(target, path))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: can't search path \"%s\" for cleanup: %s", path, err)
+			errs = append(errs, &CleanupError{Path: path, Err: fmt.Errorf("can't remove unnecessary file: %w", err)})
 		}
+	}
 
-		baseFile := filepath.Join(base, path)
-		targetFile := filepath.Join(target, path)
+	// walked folders are sorted parents first, so reversing visits children first
+	for i := len(foldersToCheck) - 1; i >= 0; i-- {
+		path := foldersToCheck[i]
 
-		targetInfo, err := os.Lstat(targetFile)
+		isRedundant, err := isRedundantFolder(filepath.Join(target, path), filepath.Join(base, path))
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Warning:", err)
-			return nil
+			errs = append(errs, &CleanupError{Path: path, Err: err})
+			continue
+		}
+		if !isRedundant {
+			continue
 		}
 
-		baseInfo, err := os.Lstat(baseFile)
+		err = os.Remove(filepath.Join(target, path))
 		if err != nil {
-			// no base file, so keep target
-			return nil
+			errs = append(errs, &CleanupError{Path: path, Err: fmt.Errorf("can't remove unnecessary folder: %w", err)})
 		}
+	}
+
+	if len(errs) != 0 {
+		return &ErrCleanupFiles{errs: errs}
+	}
+
+	return nil
+}
+
+// FindStaleShadows returns the paths of the upper which are unmodified copies
+// of the old lower that the update changed or removed. These are usually left
+// over from earlier builds and have to be removed so the new lower version wins.
+func FindStaleShadows(changes ChangeSet) []string {
+	staleShadows := []string{}
 
-		for _, comparable := range comparables {
-			if comparable.SupportsFile(targetInfo) {
-				isIdentical, err := comparable.IsIdentical(targetInfo, baseInfo, targetFile, baseFile)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Warning:", err)
-					return nil
-				}
-				if isIdentical {
-					filesToRemove = append(filesToRemove, targetFile)
-				}
-				return nil
-			}
+	for _, change := range changes {
+		if change.IsStaleShadow() {
+			staleShadows = append(staleShadows, change.Path)
 		}
+	}
 
-		return nil
-	})
+	return staleShadows
+}
 
+// isIdenticalFile checks if path exists in base and is identical to the version in target,
+// versions of different types are never identical
+func isIdenticalFile(path, target, base string) (bool, error) {
+	targetFile := filepath.Join(target, path)
+	baseFile := filepath.Join(base, path)
+
+	targetInfo, err := os.Lstat(targetFile)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Warning:", err)
-		return
+		return false, err
 	}
 
-	for _, toRemove := range filesToRemove {
-		err := os.Remove(toRemove)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Warning: can not remove unnecessary file"+toRemove+":", err)
-		}
+	baseInfo, err := os.Lstat(baseFile)
+	if err != nil {
+		// no base file, so keep target
+		return false, nil
 	}
+
+	return nodesIdentical(path, targetInfo, baseInfo, targetFile, baseFile, nil)
+}
+
+// isRedundantFolder checks if the target folder is empty and base contains
+// a folder with the same attributes, so removing target doesn't change the
+// merged view
+func isRedundantFolder(targetFolder, baseFolder string) (bool, error) {
+	entries, err := os.ReadDir(targetFolder)
+	if err != nil {
+		return false, fmt.Errorf("can't read folder: %w", err)
+	}
+	if len(entries) != 0 {
+		return false, nil
+	}
+
+	baseInfo, err := os.Lstat(baseFolder)
+	if err != nil {
+		// no base folder, so the folder was created by the user
+		return false, nil
+	}
+
+	targetInfo, err := os.Lstat(targetFolder)
+	if err != nil {
+		return false, fmt.Errorf("can't find information about folder: %w", err)
+	}
+
+	folder := Folder{}
+	if !folder.SupportsFile(baseInfo) {
+		return false, nil
+	}
+
+	return folder.IsIdentical(targetInfo, baseInfo, targetFolder, baseFolder)
 }
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const compareBufferSize = 64 * 1024
+
+// contentsIdentical compares the contents of two files byte by byte
+func contentsIdentical(aPath, bPath string) (bool, error) {
+	aFile, err := os.Open(aPath)
+	if err != nil {
+		return false, err
+	}
+	defer aFile.Close()
+
+	bFile, err := os.Open(bPath)
+	if err != nil {
+		return false, err
+	}
+	defer bFile.Close()
+
+	aBuf := make([]byte, compareBufferSize)
+	bBuf := make([]byte, compareBufferSize)
+
+	for {
+		aRead, aErr := io.ReadFull(aFile, aBuf)
+		bRead, bErr := io.ReadFull(bFile, bBuf)
+
+		if !bytes.Equal(aBuf[:aRead], bBuf[:bRead]) {
+			return false, nil
+		}
+
+		aDone := aErr == io.EOF || aErr == io.ErrUnexpectedEOF
+		bDone := bErr == io.EOF || bErr == io.ErrUnexpectedEOF
+
+		if aErr != nil && !aDone {
+			return false, aErr
+		}
+		if bErr != nil && !bDone {
+			return false, bErr
+		}
+		if aDone || bDone {
+			return aDone == bDone, nil
+		}
+	}
+}
+
+type digestEntry struct {
+	size    int64
+	modTime time.Time
+	digest  [sha256.Size]byte
+}
+
+// DigestCache remembers the SHA-256 digests of files, so files that are
+// compared against multiple others only have to be read once.
+//
+// Entries are invalidated when the size or modification time of a file changes.
+// It is safe for concurrent use.
+type DigestCache struct {
+	mutex   sync.Mutex
+	entries map[string]digestEntry
+}
+
+func NewDigestCache() *DigestCache {
+	return &DigestCache{entries: make(map[string]digestEntry)}
+}
+
+// Digest returns the SHA-256 digest of the file at path
+func (c *DigestCache) Digest(info os.FileInfo, path string) ([sha256.Size]byte, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[path]
+	c.mutex.Unlock()
+
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.digest, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("can't hash file: %w", err)
+	}
+
+	entry = digestEntry{size: info.Size(), modTime: info.ModTime()}
+	hash.Sum(entry.digest[:0])
+
+	c.mutex.Lock()
+	c.entries[path] = entry
+	c.mutex.Unlock()
+
+	return entry.digest, nil
+}
+
+// Identical compares the contents of two files by their digests
+func (c *DigestCache) Identical(a, b os.FileInfo, aPath, bPath string) (bool, error) {
+	aDigest, err := c.Digest(a, aPath)
+	if err != nil {
+		return false, err
+	}
+
+	bDigest, err := c.Digest(b, bPath)
+	if err != nil {
+		return false, err
+	}
+
+	return aDigest == bDigest, nil
+}
+
+// nodesIdentical compares two nodes of any supported type including folders,
+// nodes of different types are never identical.
+//
+// path is the path of both nodes relative to their etc folders
+func nodesIdentical(path string, a, b os.FileInfo, aPath, bPath string, digests *DigestCache) (bool, error) {
+	if a.Mode().Type() != b.Mode().Type() {
+		return false, nil
+	}
+
+	var comparable Comparable
+	switch {
+	case a.IsDir():
+		comparable = &Folder{}
+	case a.Mode().IsRegular():
+		comparable = &RegularFile{Digests: digests}
+	case a.Mode()&os.ModeSymlink != 0:
+		comparable = &Symlink{Location: filepath.Join(EtcLocation, path)}
+	case a.Mode()&os.ModeCharDevice != 0:
+		comparable = &CharDeviceFile{}
+	default:
+		return false, nil
+	}
+
+	return comparable.IsIdentical(a, b, aPath, bPath)
+}
+
+// isWhiteout checks if info describes an overlayfs whiteout,
+// a character device with device number 0/0 that hides the lower file
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	return info.Sys().(*syscall.Stat_t).Rdev == 0
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegularFileIdentical(t *testing.T) {
+	dir := t.TempDir()
+
+	// large enough to need multiple reads, differing only in the last byte,
+	// every version has the same name since files with other names differ
+	contents := strings.Repeat("a", 3*compareBufferSize)
+	writeFiles(t, map[string]string{
+		filepath.Join(dir, "a", "file"):     contents + "b",
+		filepath.Join(dir, "same", "file"):  contents + "b",
+		filepath.Join(dir, "last", "file"):  contents + "c",
+		filepath.Join(dir, "short", "file"): contents,
+	})
+
+	aPath := filepath.Join(dir, "a", "file")
+	expect := map[string]bool{"same": true, "last": false, "short": false}
+	digests := NewDigestCache()
+
+	for _, regularFile := range []*RegularFile{{}, {Digests: digests}} {
+		for name, identical := range expect {
+			bPath := filepath.Join(dir, name, "file")
+
+			isIdentical, err := contentsIdentical(aPath, bPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isIdentical != identical {
+				t.Errorf("contents of %s and a identical: %v, expected %v", name, isIdentical, identical)
+			}
+
+			isIdentical, err = regularFileIdentical(t, regularFile, aPath, bPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isIdentical != identical {
+				t.Errorf("%s and a identical with digests %t: %v, expected %v", name, regularFile.Digests != nil, isIdentical, identical)
+			}
+		}
+	}
+
+	// files of different sizes are never read
+	if _, ok := digests.entries[filepath.Join(dir, "short", "file")]; ok {
+		t.Error("file of another size was hashed")
+	}
+
+	// change a without changing its size or modification time, so only the cache still knows the old contents
+	aInfo, err := os.Lstat(aPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(aPath, []byte(contents+"c"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(aPath, aInfo.ModTime(), aInfo.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isIdentical, err := regularFileIdentical(t, &RegularFile{Digests: digests}, aPath, filepath.Join(dir, "same", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isIdentical {
+		t.Error("digest of a was not taken from the cache")
+	}
+}
+
+func regularFileIdentical(t *testing.T, regularFile *RegularFile, aPath, bPath string) (bool, error) {
+	aInfo, err := os.Lstat(aPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo, err := os.Lstat(bPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return regularFile.IsIdentical(aInfo, bInfo, aPath, bPath)
+}
@@ -3,36 +3,90 @@ package core
 import (
 	"errors"
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// CarbonCopyRecursive copies the folder from with all its contents and attributes to to.
+//
+// Paths ExcludeRules skips or regenerates are left out.
 func CarbonCopyRecursive(from, to string) error {
+	return carbonCopyRecursive(from, to, 0, isLeftOut)
+}
+
+// carbonCopyRecursive copies like CarbonCopyRecursive but leaves out all paths
+// for which skip returns true, skipping a folder skips its contents as well
+func carbonCopyRecursive(from, to string, concurrency int, skip func(path string) bool) error {
+	entries, err := walkTree(from)
+	if err != nil {
+		return fmt.Errorf("can't copy all files: %w", err)
+	}
+
+	folders := []string{}
+	folderInfos := []os.FileInfo{}
+	files := []string{}
+	skippedFolders := []string{}
+
+	// folders have to exist before their contents can be copied in parallel
+	for _, entry := range entries {
+		if skip != nil && (skip(entry.path) || isInFolders(entry.path, skippedFolders)) {
+			if entry.entry.IsDir() {
+				skippedFolders = append(skippedFolders, entry.path)
+			}
+			continue
+		}
+
+		if !entry.entry.IsDir() {
+			files = append(files, entry.path)
+			continue
+		}
 
-	err := fs.WalkDir(os.DirFS(from), ".", func(path string, d fs.DirEntry, err error) error {
+		err = CarbonCopy(filepath.Join(from, entry.path), filepath.Join(to, entry.path))
 		if err != nil {
-			return fmt.Errorf("can't search path \"%s\": %w", path, err)
+			return fmt.Errorf("can't copy all files: can't copy \"%s\": %w", entry.path, err)
 		}
 
-		from := filepath.Join(from, path)
-		to := filepath.Join(to, path)
+		folders = append(folders, entry.path)
+		folderInfos = append(folderInfos, entry.info)
+	}
 
-		err = CarbonCopy(from, to)
+	errs := forEachParallel(len(files), concurrency, func(i int) error {
+		err := CarbonCopy(filepath.Join(from, files[i]), filepath.Join(to, files[i]))
 		if err != nil {
-			return fmt.Errorf("can't copy \"%s\": %w", path, err)
+			return fmt.Errorf("can't copy \"%s\": %w", files[i], err)
 		}
 
 		return nil
 	})
 
+	err = firstError(errs)
 	if err != nil {
 		return fmt.Errorf("can't copy all files: %w", err)
 	}
 
+	// creating the contents of a folder changes its times, so restore them
+	// from the deepest folder upwards
+	for i := len(folders) - 1; i >= 0; i-- {
+		err = copyTimes(folderInfos[i], filepath.Join(to, folders[i]), 0)
+		if err != nil {
+			return fmt.Errorf("can't restore times of \"%s\": %w", folders[i], err)
+		}
+	}
+
 	return nil
 }
 
+func isInFolders(path string, folders []string) bool {
+	for _, folder := range folders {
+		if strings.HasPrefix(path, folder+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
 type Copyable interface {
 	SupportsFile(info os.FileInfo) bool
 	Copy(fromInfo os.FileInfo, from, to string) error
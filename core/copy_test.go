@@ -0,0 +1,119 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCopySparse(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "from")
+	to := filepath.Join(dir, "to")
+
+	fromFile, err := os.Create(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fromFile.WriteAt([]byte("start"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fromFile.WriteAt([]byte("middle"), 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fromFile.Truncate(16 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile.Close()
+
+	err = CarbonCopy(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromInfo, err := os.Lstat(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toInfo, err := os.Lstat(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if toInfo.Size() != fromInfo.Size() {
+		t.Fatalf("size %d instead of %d", toInfo.Size(), fromInfo.Size())
+	}
+	fromBlocks := fromInfo.Sys().(*syscall.Stat_t).Blocks
+	toBlocks := toInfo.Sys().(*syscall.Stat_t).Blocks
+	if toBlocks > fromBlocks {
+		t.Errorf("copy uses %d blocks instead of %d, holes were filled", toBlocks, fromBlocks)
+	}
+
+	identical, err := contentsIdentical(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !identical {
+		t.Fatal("contents of sparse file did not match")
+	}
+}
+
+func TestCopyTimes(t *testing.T) {
+	dir := t.TempDir()
+	fromDir := filepath.Join(dir, "from")
+	toDir := filepath.Join(dir, "to")
+
+	err := os.MkdirAll(filepath.Join(fromDir, "folder"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(fromDir, "folder", "file"), []byte("data"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("file", filepath.Join(fromDir, "folder", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atime := time.Unix(1000000000, 123456789)
+	mtime := time.Unix(1100000000, 987654321)
+	for _, path := range []string{"folder/file", "folder/link", "folder"} {
+		times := [2]syscall.Timespec{syscall.NsecToTimespec(atime.UnixNano()), syscall.NsecToTimespec(mtime.UnixNano())}
+		fromInfo, err := os.Lstat(filepath.Join(fromDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromInfo.Sys().(*syscall.Stat_t).Atim = times[0]
+		fromInfo.Sys().(*syscall.Stat_t).Mtim = times[1]
+		err = copyTimes(fromInfo, filepath.Join(fromDir, path), atSymlinkNofollow)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = CarbonCopyRecursive(fromDir, toDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"folder/file", "folder/link", "folder"} {
+		info, err := os.Lstat(filepath.Join(toDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infoUnix := info.Sys().(*syscall.Stat_t)
+
+		if infoUnix.Mtim.Nano() != mtime.UnixNano() {
+			t.Errorf("%s has mtime %d instead of %d", path, infoUnix.Mtim.Nano(), mtime.UnixNano())
+		}
+		if infoUnix.Atim.Nano() != atime.UnixNano() {
+			t.Errorf("%s has atime %d instead of %d", path, infoUnix.Atim.Nano(), atime.UnixNano())
+		}
+	}
+}
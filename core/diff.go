@@ -0,0 +1,191 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DiffStatus describes how a path of the upper differs from the lower
+type DiffStatus int
+
+const (
+	// DiffAdded means the path only exists in the upper
+	DiffAdded DiffStatus = iota
+	// DiffModified means the contents or the type of the path differ
+	DiffModified
+	// DiffMetadataOnly means only the owner or permissions differ
+	DiffMetadataOnly
+	// DiffDeleted means the upper contains a whiteout hiding the lower version
+	DiffDeleted
+	// DiffWhiteout means the upper contains a whiteout without a lower version to hide
+	DiffWhiteout
+)
+
+func (s DiffStatus) String() string {
+	switch s {
+	case DiffAdded:
+		return "added"
+	case DiffModified:
+		return "modified"
+	case DiffMetadataOnly:
+		return "metadata-only"
+	case DiffDeleted:
+		return "deleted"
+	case DiffWhiteout:
+		return "whiteout"
+	default:
+		return fmt.Sprintf("DiffStatus(%d)", int(s))
+	}
+}
+
+func (s DiffStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// PathDiff is a path of the upper that differs from the lower
+type PathDiff struct {
+	Path   string     `json:"path"`
+	Status DiffStatus `json:"status"`
+	// Diff is the unified diff of text files, it is empty for other files
+	Diff string `json:"diff,omitempty"`
+}
+
+// DiffEtc returns every path the upper changes compared to the lower.
+//
+// If oldLower isn't empty, it is used as the lower the user made their changes against:
+// paths of the upper identical to the old lower aren't changes of the user and diffs are
+// made against the old lower version if there is one.
+func DiffEtc(lower, upper, oldLower string) ([]PathDiff, error) {
+	entries, err := walkTree(upper)
+	if err != nil {
+		return nil, fmt.Errorf("can't compare etc: %w", err)
+	}
+
+	diffs := []PathDiff{}
+
+	for _, entry := range entries {
+		if entry.path == "." {
+			continue
+		}
+
+		base := lower
+		if oldLower != "" {
+			if _, err := os.Lstat(filepath.Join(oldLower, entry.path)); err == nil {
+				base = oldLower
+			}
+		}
+
+		diff, changed, err := diffPath(entry.path, base, upper, entry.info)
+		if err != nil {
+			return nil, fmt.Errorf("can't compare \"%s\": %w", entry.path, err)
+		}
+		if changed {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	return diffs, nil
+}
+
+func diffPath(path, lower, upper string, upperInfo os.FileInfo) (PathDiff, bool, error) {
+	diff := PathDiff{Path: path}
+
+	lowerPath := filepath.Join(lower, path)
+	upperPath := filepath.Join(upper, path)
+
+	lowerInfo, err := os.Lstat(lowerPath)
+	inLower := err == nil
+
+	switch {
+	case isWhiteout(upperInfo) && inLower:
+		diff.Status = DiffDeleted
+		return diff, true, nil
+	case isWhiteout(upperInfo):
+		diff.Status = DiffWhiteout
+		return diff, true, nil
+	case !inLower:
+		diff.Status = DiffAdded
+		diff.Diff, err = textDiff("/dev/null", "b/"+path, "", upperPath)
+		return diff, true, err
+	}
+
+	identical, err := nodesIdentical(path, lowerInfo, upperInfo, lowerPath, upperPath, nil)
+	if err != nil || identical {
+		return diff, false, err
+	}
+
+	sameContents, err := contentsMatch(path, lowerInfo, upperInfo, lowerPath, upperPath)
+	if err != nil {
+		return diff, false, err
+	}
+	if sameContents {
+		diff.Status = DiffMetadataOnly
+		return diff, true, nil
+	}
+
+	diff.Status = DiffModified
+	if lowerInfo.Mode().IsRegular() {
+		diff.Diff, err = textDiff("a/"+path, "b/"+path, lowerPath, upperPath)
+	}
+
+	return diff, true, err
+}
+
+// contentsMatch compares two nodes like nodesIdentical, but ignores their attributes
+func contentsMatch(path string, a, b os.FileInfo, aPath, bPath string) (bool, error) {
+	if nodeTypeOf(a) != nodeTypeOf(b) {
+		return false, nil
+	}
+
+	switch nodeTypeOf(a) {
+	case NodeRegularFile:
+		if a.Size() != b.Size() {
+			return false, nil
+		}
+		return contentsIdentical(aPath, bPath)
+	case NodeSymlink:
+		return (&Symlink{Location: filepath.Join(EtcLocation, path)}).IsIdentical(a, b, aPath, bPath)
+	case NodeFolder:
+		return true, nil
+	case NodeDevice:
+		return a.Sys().(*syscall.Stat_t).Rdev == b.Sys().(*syscall.Stat_t).Rdev, nil
+	default:
+		return false, nil
+	}
+}
+
+// textDiff returns the unified diff of two files, aPath may be empty for a new file.
+// Files that aren't regular or look binary have no diff.
+func textDiff(aName, bName, aPath, bPath string) (string, error) {
+	if !isRegularFile(bPath) {
+		return "", nil
+	}
+
+	aContents := []byte{}
+	if aPath != "" {
+		var err error
+		aContents, err = os.ReadFile(aPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	bContents, err := os.ReadFile(bPath)
+	if err != nil {
+		return "", err
+	}
+
+	if isBinary(aContents) || isBinary(bContents) {
+		return "", nil
+	}
+
+	return unifiedDiff(aName, bName, string(aContents), string(bContents)), nil
+}
+
+// isBinary guesses if contents are binary like git does, by looking for a NUL byte at the start
+func isBinary(contents []byte) bool {
+	return bytes.IndexByte(contents[:min(len(contents), 8000)], 0) >= 0
+}
@@ -0,0 +1,233 @@
+package core
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   string
+		expect string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", ""},
+		{"added to empty", "", "a\nb\n", "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"removed everything", "a\n", "", "--- a\n+++ b\n@@ -1,1 +0,0 @@\n-a\n"},
+		{
+			"changed line with context",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			"--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"separate hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			"--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+		{
+			"close changes share a hunk",
+			"1\n2\n3\n4\n5\n6\n7\n8\n",
+			"one\n2\n3\n4\n5\n6\n7\neight\n",
+			"--- a\n+++ b\n@@ -1,8 +1,8 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n",
+		},
+	}
+
+	for _, test := range tests {
+		result := unifiedDiff("a", "b", test.a, test.b)
+		if result != test.expect {
+			t.Errorf("%s: got\n%s\ninstead of\n%s", test.name, result, test.expect)
+		}
+	}
+}
+
+func TestEditScriptMinimal(t *testing.T) {
+	random := rand.New(rand.NewPCG(1, 2))
+	randomLines := func() []string {
+		lines := make([]string, random.IntN(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + random.IntN(3)))
+		}
+		return lines
+	}
+
+	for range 2000 {
+		a, b := randomLines(), randomLines()
+		ops := editScript(a, b)
+
+		aResult, bResult := []string{}, []string{}
+		edits := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				aResult = append(aResult, op.line)
+			}
+			if op.kind != '-' {
+				bResult = append(bResult, op.line)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if !slices.Equal(aResult, a) || !slices.Equal(bResult, b) {
+			t.Fatalf("edit script of %v and %v is wrong: %v", a, b, ops)
+		}
+
+		// the shortest script removes and adds everything but the longest common subsequence
+		common := make([][]int, len(a)+1)
+		for i := range common {
+			common[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					common[i][j] = common[i+1][j+1] + 1
+				} else {
+					common[i][j] = max(common[i+1][j], common[i][j+1])
+				}
+			}
+		}
+		if shortest := len(a) + len(b) - 2*common[0][0]; edits != shortest {
+			t.Fatalf("edit script of %v and %v has %d edits instead of %d", a, b, edits, shortest)
+		}
+	}
+}
+
+func TestUnifiedDiffLarge(t *testing.T) {
+	a, b := strings.Builder{}, strings.Builder{}
+	for i := range 3000 {
+		fmt.Fprintf(&a, "old line %d\n", i)
+		fmt.Fprintf(&b, "new line %d\n", i)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	result := unifiedDiff("a", "b", a.String(), b.String())
+	runtime.ReadMemStats(&after)
+
+	if !strings.HasPrefix(result, "--- a\n+++ b\n@@ -1,3000 +1,3000 @@\n-old line 0\n") {
+		t.Errorf("diff of completely different files is wrong:\n%s", result[:min(len(result), 200)])
+	}
+	if strings.Count(result, "\n-") != 3000 || strings.Count(result, "\n+") != 3001 {
+		t.Error("diff doesn't remove and add every line")
+	}
+
+	// keeping every step of the search would allocate hundreds of MB
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 32<<20 {
+		t.Errorf("diff allocated %d MB", allocated>>20)
+	}
+}
+
+func TestDiffEtc(t *testing.T) {
+	lower := t.TempDir()
+	upper := t.TempDir()
+
+	files := map[string]string{
+		filepath.Join(lower, "hosts"):         "127.0.0.1 localhost\n",
+		filepath.Join(upper, "hosts"):         "127.0.0.1 localhost\n192.168.1.2 nas\n",
+		filepath.Join(lower, "fstab"):         "# empty\n",
+		filepath.Join(upper, "fstab"):         "# empty\n",
+		filepath.Join(lower, "unchanged"):     "same\n",
+		filepath.Join(upper, "unchanged"):     "same\n",
+		filepath.Join(upper, "motd"):          "welcome\n",
+		filepath.Join(upper, "binary"):        "\x00\x01",
+		filepath.Join(lower, "nsswitch.conf"): "passwd: files\n",
+	}
+	writeFiles(t, files)
+
+	err := os.Chmod(filepath.Join(upper, "fstab"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syscall.Mknod(filepath.Join(upper, "nsswitch.conf"), syscall.S_IFCHR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Mknod(filepath.Join(upper, "gone"), syscall.S_IFCHR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := DiffEtc(lower, upper, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]DiffStatus{
+		"hosts":         DiffModified,
+		"fstab":         DiffMetadataOnly,
+		"motd":          DiffAdded,
+		"binary":        DiffAdded,
+		"nsswitch.conf": DiffDeleted,
+		"gone":          DiffWhiteout,
+	}
+
+	if len(diffs) != len(expect) {
+		t.Errorf("%d paths differ instead of %d: %v", len(diffs), len(expect), diffs)
+	}
+
+	for _, diff := range diffs {
+		status, ok := expect[diff.Path]
+		if !ok {
+			t.Errorf("%s differs, but shouldn't", diff.Path)
+			continue
+		}
+		if diff.Status != status {
+			t.Errorf("%s is %s instead of %s", diff.Path, diff.Status, status)
+		}
+
+		switch diff.Path {
+		case "hosts":
+			if !strings.Contains(diff.Diff, "--- a/hosts\n+++ b/hosts\n") || !strings.Contains(diff.Diff, "+192.168.1.2 nas\n") {
+				t.Errorf("diff of hosts is wrong:\n%s", diff.Diff)
+			}
+		case "motd":
+			if !strings.Contains(diff.Diff, "--- /dev/null\n+++ b/motd\n") {
+				t.Errorf("diff of motd is wrong:\n%s", diff.Diff)
+			}
+		default:
+			if diff.Diff != "" {
+				t.Errorf("%s has a diff, but shouldn't:\n%s", diff.Path, diff.Diff)
+			}
+		}
+	}
+}
+
+func TestDiffEtcOldLower(t *testing.T) {
+	oldLower := t.TempDir()
+	lower := t.TempDir()
+	upper := t.TempDir()
+
+	files := map[string]string{
+		// an unmodified copy of the old lower isn't a change of the user
+		filepath.Join(oldLower, "issue"): "Welcome to 1.0\n",
+		filepath.Join(lower, "issue"):    "Welcome to 2.0\n",
+		filepath.Join(upper, "issue"):    "Welcome to 1.0\n",
+		filepath.Join(oldLower, "hosts"): "127.0.0.1 localhost\n",
+		filepath.Join(lower, "hosts"):    "127.0.0.1 localhost\n::1 localhost\n",
+		filepath.Join(upper, "hosts"):    "127.0.0.1 localhost\n192.168.1.2 nas\n",
+	}
+	writeFiles(t, files)
+
+	diffs, err := DiffEtc(lower, upper, oldLower)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 1 || diffs[0].Path != "hosts" {
+		t.Fatalf("only hosts should differ: %v", diffs)
+	}
+
+	expect := "--- a/hosts\n+++ b/hosts\n@@ -1,1 +1,2 @@\n 127.0.0.1 localhost\n+192.168.1.2 nas\n"
+	if diffs[0].Diff != expect {
+		t.Errorf("hosts wasn't compared with the old lower:\n%s", diffs[0].Diff)
+	}
+}
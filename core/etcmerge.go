@@ -3,10 +3,11 @@ package core
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
-	"strings"
+	"syscall"
 )
 
 type ErrMergeFiles struct {
@@ -22,73 +23,514 @@ func (e *ErrMergeFiles) Unwrap() []error {
 	return e.errs
 }
 
+// CleanupErrorPolicy decides how problems while removing unnecessary files are handled
+type CleanupErrorPolicy int
+
+const (
+	// CleanupErrorsWarn reports cleanup problems as warnings and keeps the affected files
+	CleanupErrorsWarn CleanupErrorPolicy = iota
+	// CleanupErrorsFatal fails the build if the cleanup had any problems
+	CleanupErrorsFatal
+)
+
+// BuildOptions configures how a new etc is built
+type BuildOptions struct {
+	// Concurrency limits how many files are copied, compared or changed
+	// at the same time, values below 1 use one worker per CPU
+	Concurrency int
+	// CleanupErrors decides if cleanup problems fail the build
+	CleanupErrors CleanupErrorPolicy
+	// Root is the root folder of the new system, if set it is used to check
+	// that files referenced in the etc exist
+	Root string
+	// TypeChanges decides how paths whose type the update changed are handled
+	TypeChanges TypeChangePolicy
+	// ResolveSidecars drops or merges sidecars like .rpmnew instead of only reporting them
+	ResolveSidecars bool
+	// Policy overrides how single paths are handled, paths without a rule are
+	// handled according to the exclude rules or the default
+	Policy *Policy
+	// MergeRules are used in front of the global MergeRules
+	MergeRules []MergeRule
+	// ExcludeRules are used in front of the global ExcludeRules
+	ExcludeRules []ExcludeRule
+}
+
+func DefaultBuildOptions() BuildOptions {
+	return BuildOptions{Concurrency: 0, CleanupErrors: CleanupErrorsWarn, TypeChanges: TypeChangesKeepUser}
+}
+
+func (o BuildOptions) rules() *buildRules {
+	return &buildRules{
+		policy:  o.Policy,
+		merge:   slices.Concat(o.MergeRules, MergeRules),
+		exclude: slices.Concat(o.ExcludeRules, ExcludeRules),
+	}
+}
+
+// BuildReport describes everything noteworthy that happened while building a new etc
+type BuildReport struct {
+	// Warnings are problems that didn't stop the build
+	Warnings []error
+	// Changes classifies every path of the old upper against the old and new lower
+	Changes ChangeSet
+	// StaleShadows are unmodified copies of the old lower that were dropped
+	// from the upper so the new lower version is used
+	StaleShadows []string
+	// KeptStaleShadows are unmodified copies of the old lower that were kept, since
+	// the policy keeps them or they are folders containing changes of the user
+	KeptStaleShadows []string
+	// Merged are the files that were changed by merging with the strategy configured in the merge rules
+	Merged []string
+	// Conflicts are changes of the update that weren't applied in favor of the user's version
+	Conflicts []Conflict
+	// Regenerate are paths of the upper that were left out since the
+	// new system has to regenerate them, see ExcludeRegenerate
+	Regenerate []string
+	// Sidecars are the sidecars like .rpmnew found in the upper and what happened to them
+	Sidecars []Sidecar
+	// TypeChanges are paths whose type the update changed while the upper had its own version
+	TypeChanges []TypeChange
+	// DanglingSymlinks are symlinks of the user pointing to paths that don't exist
+	// in the new system, they are only searched if BuildOptions.Root is set
+	DanglingSymlinks []DanglingSymlink
+}
+
 // BuildNewEtc fixes the owner of the new lower etc folder and create the new upper etc folder
+//
+// warnings are printed to stderr, use BuildNewEtcWithOptions to handle them yourself
 func BuildNewEtc(lowerOld, upperOld, lowerNew, upperNew string) error {
+	report, err := BuildNewEtcWithOptions(lowerOld, upperOld, lowerNew, upperNew, DefaultBuildOptions())
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range report.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
+
+	return nil
+}
 
+// BuildNewEtcWithOptions works like BuildNewEtc but can be configured with options
+// and returns a report instead of printing warnings
+func BuildNewEtcWithOptions(lowerOld, upperOld, lowerNew, upperNew string, options BuildOptions) (*BuildReport, error) {
 	os.RemoveAll(upperNew)
 	os.MkdirAll(lowerOld, 0x755)
 	os.MkdirAll(upperOld, 0x755)
 	os.MkdirAll(lowerNew, 0x755)
 
-	err := CarbonCopyRecursive(upperOld, upperNew)
+	plan, err := planBuild(lowerOld, lowerNew, upperOld, options)
 	if err != nil {
-		return fmt.Errorf("can't create new upper etc: %w", err)
+		return nil, err
+	}
+
+	report := &BuildReport{
+		Warnings:         plan.warnings,
+		Changes:          plan.changes,
+		StaleShadows:     plan.staleShadows,
+		KeptStaleShadows: plan.keptStaleShadows,
+		Merged:           plan.merged,
+		Conflicts:        plan.conflicts,
+		Regenerate:       plan.regenerate,
+		Sidecars:         plan.sidecars,
+		TypeChanges:      plan.typeChanges,
 	}
 
-	groupFile, groupMapping, err := handleGroupFiles(upperOld, lowerNew, upperNew)
+	err = applyBuildPlan(plan, upperOld, lowerNew, upperNew, options.Concurrency)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// identical versions the user pinned are kept, so they don't follow later updates
+	err = removeIdenticalFiles(upperNew, lowerNew, options.Concurrency, func(path string) bool {
+		return effectiveRule(plan.rules, path).keepsUser()
+	})
+	if err != nil {
+		if options.CleanupErrors == CleanupErrorsFatal {
+			return nil, fmt.Errorf("can't remove unnecessary files: %w", err)
+		}
+
+		var cleanupErr *ErrCleanupFiles
+		if errors.As(err, &cleanupErr) {
+			report.Warnings = append(report.Warnings, cleanupErr.Unwrap()...)
+		} else {
+			report.Warnings = append(report.Warnings, err)
+		}
 	}
 
-	_, err = MergeInGshadow(upperNew, lowerNew)
+	report.Warnings = append(report.Warnings, validateIdentityFiles(upperNew)...)
+
+	if options.Root != "" {
+		report.DanglingSymlinks, err = findDanglingSymlinks(upperNew, lowerNew, options.Root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// buildPlan is everything building a new etc from the upper does, worked out without writing anything
+type buildPlan struct {
+	rules    *buildRules
+	accounts *mergedAccounts
+	changes  ChangeSet
+	// dropped are the paths of the upper that aren't carried into the new upper
+	dropped          map[string]bool
+	regenerate       []string
+	staleShadows     []string
+	keptStaleShadows []string
+	// shells are the merged contents of the shells file, nil if the user has none
+	shells      []byte
+	typeChanges []TypeChange
+	sidecars    []Sidecar
+	// mergedFiles are the merged contents of the paths in merged
+	mergedFiles map[string][]byte
+	merged      []string
+	conflicts   []Conflict
+	warnings    []error
+}
+
+// planBuild works out how the upper is carried into a new upper for the new lower,
+// BuildNewEtcWithOptions applies the plan and PreviewUpdate reports it
+func planBuild(lowerOld, lowerNew, upper string, options BuildOptions) (*buildPlan, error) {
+	plan := &buildPlan{rules: options.rules(), warnings: []error{}}
+	digests := NewDigestCache()
+
+	var err error
+	plan.accounts, err = mergeAccounts(lowerOld, lowerNew, upper, options.TypeChanges, plan.rules, digests)
 	if err != nil {
-		return fmt.Errorf("can't merge lower gshadow file into upper: %w", err)
+		return nil, err
 	}
 
-	_, userMapping, err := handlePasswdFiles(upperOld, lowerNew, upperNew, groupFile, groupMapping)
+	plan.changes, err = classifyChanges(lowerOld, lowerNew, upper, options.Concurrency, digests, plan.accounts.ownerMapping())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = MergeInShadow(upperNew, lowerNew)
+	var typeChangeDrops map[string]bool
+	plan.dropped, typeChangeDrops = droppedForBuild(plan.changes, options.TypeChanges, plan.rules)
+
+	plan.regenerate = regeneratedPaths(plan.changes, plan.dropped, plan.rules)
+	plan.staleShadows, plan.keptStaleShadows = splitStaleShadows(plan.changes, plan.dropped, plan.rules)
+
+	var shellsWarnings []error
+	plan.shells, shellsWarnings, err = planShellsFile(plan.changes, plan.dropped, lowerOld, lowerNew, upper, options.Root)
 	if err != nil {
-		return fmt.Errorf("can't merge lower shadow file into upper: %w", err)
+		return nil, err
 	}
+	plan.warnings = append(plan.warnings, shellsWarnings...)
 
-	_, err = MergeInShells(upperNew, lowerNew)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("can't merge lower shells file into upper: %w", err)
+	var typeConflicts []Conflict
+	plan.typeChanges, typeConflicts = resolveTypeChanges(plan.changes, plan.dropped, plan.rules, lowerNew)
+	handled := separatelyHandledPaths(plan.typeChanges, typeChangeDrops)
+
+	var sidecarBases map[string]string
+	plan.sidecars, sidecarBases, err = resolveSidecars(plan.changes, plan.dropped, handled, plan.rules, options.ResolveSidecars, lowerNew, upper)
+	if err != nil {
+		return nil, err
 	}
 
-	err = ApplyOwnerMappingRecursive(lowerNew, userMapping, groupMapping)
+	var mergeConflicts []Conflict
+	plan.mergedFiles, mergeConflicts, err = mergeChangedFiles(plan.changes, handled, sidecarBases, plan.rules, lowerOld, lowerNew, upper)
+	if err != nil {
+		return nil, err
+	}
+	plan.merged = slices.Sorted(maps.Keys(plan.mergedFiles))
+
+	finishMergedSidecars(plan.sidecars, sidecarBases, mergeConflicts, upper)
+	plan.conflicts = append(typeConflicts, mergeConflicts...)
+
+	return plan, nil
+}
+
+// applyBuildPlan creates the new upper from the upper according to the plan and
+// gives the files of the new lower the ids the accounts have in the new upper
+func applyBuildPlan(plan *buildPlan, upperOld, lowerNew, upperNew string, concurrency int) error {
+	err := carbonCopyRecursive(upperOld, upperNew, concurrency, func(path string) bool {
+		return plan.dropped[path]
+	})
+	if err != nil {
+		return fmt.Errorf("can't create new upper etc: %w", err)
+	}
+
+	err = updateKeptStaleShadows(plan.changes, plan.keptStaleShadows, plan.rules, lowerNew, upperNew)
+	if err != nil {
+		return err
+	}
+
+	if plan.accounts.hasGroups {
+		err = plan.accounts.groupFile.WriteToFile(filepath.Join(upperNew, "group"))
+		if err != nil {
+			return fmt.Errorf("can't write merged group file: %w", err)
+		}
+	}
+
+	if hasUserVersion(plan.changes, plan.dropped, "gshadow") {
+		_, err = MergeInGshadow(upperNew, lowerNew)
+		if err != nil {
+			return fmt.Errorf("can't merge lower gshadow file into upper: %w", err)
+		}
+	}
+
+	if plan.accounts.hasUsers {
+		err = plan.accounts.passwdFile.WriteToFile(filepath.Join(upperNew, "passwd"))
+		if err != nil {
+			return fmt.Errorf("can't write merged passwd file: %w", err)
+		}
+	}
+
+	if hasUserVersion(plan.changes, plan.dropped, "shadow") {
+		_, err = MergeInShadow(upperNew, lowerNew)
+		if err != nil {
+			return fmt.Errorf("can't merge lower shadow file into upper: %w", err)
+		}
+	}
+
+	if plan.shells != nil {
+		err = os.WriteFile(filepath.Join(upperNew, "shells"), plan.shells, 0o644)
+		if err != nil {
+			return fmt.Errorf("can't write shells file: %w", err)
+		}
+	}
+
+	for _, sidecar := range plan.sidecars {
+		if sidecar.Action == SidecarKept {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(upperNew, sidecar.Path))
+		if err != nil {
+			return fmt.Errorf("can't remove sidecar %s: %w", sidecar.Path, err)
+		}
+	}
+
+	for _, path := range plan.merged {
+		err = os.WriteFile(filepath.Join(upperNew, path), plan.mergedFiles[path], 0o644)
+		if err != nil {
+			return fmt.Errorf("can't write merged file %s: %w", path, err)
+		}
+	}
+
+	err = applyOwnerMappingRecursive(lowerNew, plan.accounts.userMapping, plan.accounts.groupMapping, syscall.Chown, concurrency)
 	if err != nil {
 		return fmt.Errorf("can't apply owner mapping: %w", err)
 	}
 
-	RemoveIdenticalFiles(upperNew, lowerNew)
+	return nil
+}
+
+// droppedForBuild returns the paths of the upper that aren't carried into the new upper,
+// and the ones of them that are dropped since the update changed their type
+func droppedForBuild(changes ChangeSet, typeChanges TypeChangePolicy, rules *buildRules) (map[string]bool, map[string]bool) {
+	// unmodified copies of the old lower would hide changes and removals of the update
+	typeChangeDrops := droppedByTypeChange(changes, typeChanges)
+	dropped := droppedUpperPaths(changes, func(change PathChange) bool {
+		switch effectiveRule(rules, change.Path).Action {
+		case PolicyIgnore:
+			return true
+		case PolicyTakeUpstream:
+			return change.InLowerOld || change.InLowerNew
+		case PolicyKeepUser, PolicyConflictOnChange:
+			return false
+		}
+
+		return change.IsStaleShadow() || typeChangeDrops[change.Path]
+	})
+
+	return dropped, typeChangeDrops
+}
+
+// separatelyHandledPaths returns the paths mergeChangedFiles has to leave out,
+// since they are merged on their own or their type changed
+func separatelyHandledPaths(typeChanges []TypeChange, typeChangeDrops map[string]bool) map[string]bool {
+	handled := map[string]bool{"group": true, "gshadow": true, "passwd": true, "shadow": true, "shells": true}
+
+	for _, typeChange := range typeChanges {
+		handled[typeChange.Path] = true
+	}
+	for path := range typeChangeDrops {
+		handled[path] = true
+	}
+
+	return handled
+}
+
+// regeneratedPaths returns the dropped paths of the upper that are left
+// out because they are regenerated and no policy rule decided otherwise
+func regeneratedPaths(changes ChangeSet, dropped map[string]bool, rules *buildRules) []string {
+	regenerated := []string{}
+
+	for _, change := range changes {
+		if !dropped[change.Path] || rules.policy.RuleFor(change.Path).Action != PolicyDefault {
+			continue
+		}
+
+		category, excluded := rules.excludeCategory(change.Path)
+		if excluded && category == ExcludeRegenerate {
+			regenerated = append(regenerated, change.Path)
+		}
+	}
+
+	return regenerated
+}
+
+// droppedUpperPaths returns the paths of the upper that shouldn't be carried
+// into the new upper according to drop. Folders are only dropped if none of
+// their contents are kept.
+func droppedUpperPaths(changes ChangeSet, drop func(change PathChange) bool) map[string]bool {
+	dropped := make(map[string]bool)
+	hasKeptContents := make(map[string]bool)
+
+	// children are sorted after their parents, so they are visited first
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if !change.InUpper {
+			continue
+		}
+
+		if drop(change) && !hasKeptContents[change.Path] {
+			dropped[change.Path] = true
+			continue
+		}
+
+		hasKeptContents[filepath.Dir(change.Path)] = true
+	}
+
+	return dropped
+}
+
+// updateKeptStaleShadows gives the kept stale shadows that are folders and only had to be
+// kept for their contents the attributes of the new lower. Stale shadows the policy keeps
+// are left alone.
+func updateKeptStaleShadows(changes ChangeSet, keptShadows []string, rules *buildRules, lowerNew, upperNew string) error {
+	for _, path := range keptShadows {
+		change, _ := changes.Get(path)
+		if !change.InLowerNew || effectiveRule(rules, path).keepsUser() {
+			continue
+		}
+
+		newInfo, err := os.Lstat(filepath.Join(lowerNew, path))
+		if err != nil {
+			return fmt.Errorf("can't find information about \"%s\": %w", path, err)
+		}
+		if !newInfo.IsDir() {
+			continue
+		}
+
+		err = (&Folder{}).CopyAttributes(newInfo, filepath.Join(upperNew, path))
+		if err != nil {
+			return fmt.Errorf("can't update attributes of stale folder \"%s\": %w", path, err)
+		}
+	}
 
 	return nil
 }
 
-func handleGroupFiles(upperOld, lowerNew, upperNew string) (*GroupFile, map[int]int, error) {
-	groupFile, err := NewGroupFile(filepath.Join(upperOld, "group"))
+// splitStaleShadows returns the stale shadows that are dropped and the ones that are kept,
+// since the policy keeps them or they are folders with contents of the user. Stale shadows
+// the policy ignores are in neither.
+func splitStaleShadows(changes ChangeSet, dropped map[string]bool, rules *buildRules) ([]string, []string) {
+	droppedShadows := []string{}
+	keptShadows := []string{}
+
+	for _, path := range FindStaleShadows(changes) {
+		rule := effectiveRule(rules, path)
+
+		switch {
+		case rule.Action == PolicyIgnore:
+		case dropped[path] && !rule.keepsUser():
+			droppedShadows = append(droppedShadows, path)
+		default:
+			keptShadows = append(keptShadows, path)
+		}
+	}
+
+	return droppedShadows, keptShadows
+}
+
+// hasUserVersion checks if the upper contains a version of path that was
+// carried into the new upper and has to be merged
+func hasUserVersion(changes ChangeSet, dropped map[string]bool, path string) bool {
+	change, _ := changes.Get(path)
+	return change.InUpper && !dropped[path]
+}
+
+// mergedAccounts are the groups and users of the new lower merged into the user's ones
+type mergedAccounts struct {
+	groupFile    *GroupFile
+	groupMapping map[int]int
+	passwdFile   *PasswdFile
+	userMapping  map[int]int
+	// hasGroups and hasUsers are set if the user's group and passwd files are carried into the new upper
+	hasGroups bool
+	hasUsers  bool
+}
+
+// mergeAccounts merges the groups and users of the new lower into the user's ones without
+// writing them. Only the account files are classified for it, so all other paths can be
+// classified with the owners the new lower gets afterwards.
+func mergeAccounts(lowerOld, lowerNew, upperOld string, typeChanges TypeChangePolicy, rules *buildRules, digests *DigestCache) (*mergedAccounts, error) {
+	accountChanges := ChangeSet{}
+	for _, path := range []string{"group", "passwd"} {
+		change, err := classifyPath(path, lowerOld, lowerNew, upperOld, digests, nil)
+		if err != nil {
+			return nil, fmt.Errorf("can't classify \"%s\": %w", path, err)
+		}
+		accountChanges = append(accountChanges, change)
+	}
+
+	dropped, _ := droppedForBuild(accountChanges, typeChanges, rules)
+	accounts := &mergedAccounts{
+		hasGroups: hasUserVersion(accountChanges, dropped, "group"),
+		hasUsers:  hasUserVersion(accountChanges, dropped, "passwd"),
+	}
+
+	var err error
+	accounts.groupFile, accounts.groupMapping, err = mergeGroupFiles(upperOld, lowerNew, accounts.hasGroups)
 	if err != nil {
-		return nil, nil, fmt.Errorf("can't open current group file: %w", err)
+		return nil, err
+	}
+
+	accounts.passwdFile, accounts.userMapping, err = mergePasswdFiles(upperOld, lowerNew, accounts.groupFile, accounts.groupMapping, accounts.hasUsers)
+	if err != nil {
+		return nil, err
 	}
 
+	return accounts, nil
+}
+
+func (a *mergedAccounts) ownerMapping() *ownerMapping {
+	return &ownerMapping{users: a.userMapping, groups: a.groupMapping}
+}
+
+// mergeGroupFiles merges the groups of the new lower into the ones of the upper without
+// writing them, returns the merged groups and the mapping of the new lower gids to them
+func mergeGroupFiles(upperOld, lowerNew string, inUpper bool) (*GroupFile, map[int]int, error) {
 	newLowerGroupFile, err := NewGroupFile(filepath.Join(lowerNew, "group"))
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't open new lower group file: %w", err)
 	}
 
-	errs := groupFile.MergeWithOther(*newLowerGroupFile)
-	if len(errs) != 0 {
-		return nil, nil, &ErrMergeFiles{msg: "can't merge groups", errs: errs}
+	if !inUpper {
+		// the user never changed groups, so the lower one is used as is
+		groupMapping, err := CreateGroupMapping(*newLowerGroupFile, *newLowerGroupFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't create group mapping: %w", err)
+		}
+
+		return newLowerGroupFile, groupMapping, nil
 	}
 
-	err = groupFile.WriteToFile(filepath.Join(upperNew, "group"))
+	groupFile, err := NewGroupFile(filepath.Join(upperOld, "group"))
 	if err != nil {
-		return nil, nil, fmt.Errorf("can't write merged group file: %w", err)
+		return nil, nil, fmt.Errorf("can't open current group file: %w", err)
+	}
+
+	errs := groupFile.MergeWithOther(*newLowerGroupFile)
+	if len(errs) != 0 {
+		return nil, nil, &ErrMergeFiles{msg: "can't merge groups", errs: errs}
 	}
 
 	groupMapping, err := CreateGroupMapping(*newLowerGroupFile, *groupFile)
@@ -99,15 +541,27 @@ func handleGroupFiles(upperOld, lowerNew, upperNew string) (*GroupFile, map[int]
 	return groupFile, groupMapping, nil
 }
 
-func handlePasswdFiles(upperOld, lowerNew, upperNew string, groupFile *GroupFile, groupMapping map[int]int) (*PasswdFile, map[int]int, error) {
-	passwdFile, err := NewPasswdFile(filepath.Join(upperOld, "passwd"))
+// mergePasswdFiles merges the users of the new lower into the ones of the upper without
+// writing them, returns the merged users and the mapping of the new lower uids to them
+func mergePasswdFiles(upperOld, lowerNew string, groupFile *GroupFile, groupMapping map[int]int, inUpper bool) (*PasswdFile, map[int]int, error) {
+	newLowerPasswdFile, err := NewPasswdFile(filepath.Join(lowerNew, "passwd"))
 	if err != nil {
-		return nil, nil, fmt.Errorf("can't open current passwd file: %w", err)
+		return nil, nil, fmt.Errorf("can't open new lower passwd file: %w", err)
 	}
 
-	newLowerPasswdFile, err := NewPasswdFile(filepath.Join(lowerNew, "passwd"))
+	if !inUpper {
+		// the user never changed users, so the lower one is used as is
+		userMapping, err := CreateUserMapping(*newLowerPasswdFile, *newLowerPasswdFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't create user mapping: %w", err)
+		}
+
+		return newLowerPasswdFile, userMapping, nil
+	}
+
+	passwdFile, err := NewPasswdFile(filepath.Join(upperOld, "passwd"))
 	if err != nil {
-		return nil, nil, fmt.Errorf("can't open new lower passwd file: %w", err)
+		return nil, nil, fmt.Errorf("can't open current passwd file: %w", err)
 	}
 
 	var nogroupGid int
@@ -122,11 +576,6 @@ func handlePasswdFiles(upperOld, lowerNew, upperNew string, groupFile *GroupFile
 		return nil, nil, &ErrMergeFiles{msg: "can't merge users", errs: errs}
 	}
 
-	err = passwdFile.WriteToFile(filepath.Join(upperNew, "passwd"))
-	if err != nil {
-		return nil, nil, fmt.Errorf("can't write merged passwd file: %w", err)
-	}
-
 	userMapping, err := CreateUserMapping(*newLowerPasswdFile, *passwdFile)
 	if err != nil {
 		return nil, nil, fmt.Errorf("can't create user mapping: %w", err)
@@ -135,56 +584,81 @@ func handlePasswdFiles(upperOld, lowerNew, upperNew string, groupFile *GroupFile
 	return passwdFile, userMapping, nil
 }
 
-// MergeInShells merges extra entries from the shells file in extraShellsDir into the shells file in shellsDir
-func MergeInShells(shellsDir, extraShellsDir string) (int, error) {
-	shellsFilePath := filepath.Join(shellsDir, "shells")
-	extraShellsFilePath := filepath.Join(extraShellsDir, "shells")
-
-	shellsFileContents, err := os.ReadFile(shellsFilePath)
+// MergeInShells merges the changes the update made to the shells file into the user's one.
+//
+// The shells file in shellsDir is the user's one and gets overwritten, extraShellsDir contains the
+// updated version and baseShellsDir the version before the update. The files are merged with a
+// LineSetMerger, so comments are merged as well and the user's order is kept.
+//
+// If root isn't empty, shells of the base or the update that don't exist in root are removed.
+// Shells only the user added are kept even if they don't exist, since the user may install them later.
+//
+// returns the number of added shells, the shells that were removed because they don't exist
+// and the user's shells that were kept although they don't exist
+func MergeInShells(shellsDir, extraShellsDir, baseShellsDir, root string) (int, []string, []string, error) {
+	mergedFileContents, addedCount, removedShells, keptShells, err := mergeShellsFiles(shellsDir, extraShellsDir, baseShellsDir, root)
 	if err != nil {
-		return 0, fmt.Errorf("can't open shells file: %w", err)
+		return 0, nil, nil, err
 	}
-	extraShellsFileContents, err := os.ReadFile(extraShellsFilePath)
+
+	err = os.WriteFile(filepath.Join(shellsDir, "shells"), mergedFileContents, 0o644)
 	if err != nil {
-		return 0, fmt.Errorf("can't open extra shells file: %w", err)
+		return 0, nil, nil, fmt.Errorf("can't write shells file: %w", err)
 	}
 
-	shellsList := []string{}
+	return addedCount, removedShells, keptShells, nil
+}
 
-	for line := range strings.SplitSeq(string(shellsFileContents), "\n") {
-		line := strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		shellsList = append(shellsList, line)
+// mergeShellsFiles merges the shells files like MergeInShells without writing the result
+func mergeShellsFiles(shellsDir, extraShellsDir, baseShellsDir, root string) ([]byte, int, []string, []string, error) {
+	shellsFileContents, err := os.ReadFile(filepath.Join(shellsDir, "shells"))
+	if err != nil {
+		return nil, 0, nil, nil, fmt.Errorf("can't open shells file: %w", err)
+	}
+	extraShellsFileContents, err := os.ReadFile(filepath.Join(extraShellsDir, "shells"))
+	if err != nil {
+		return nil, 0, nil, nil, fmt.Errorf("can't open extra shells file: %w", err)
+	}
+	baseShellsFileContents, err := os.ReadFile(filepath.Join(baseShellsDir, "shells"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil, nil, fmt.Errorf("can't open base shells file: %w", err)
 	}
 
-	for index, line := range shellsList {
-		line = strings.TrimSpace(line)
-		shellsList[index] = line
+	merger := &LineSetMerger{CommentPrefix: "#"}
+	if root != "" {
+		merger.Validate = func(shell string) bool {
+			return existsInRoot(root, shell)
+		}
 	}
 
-	addedCount := 0
+	mergedFileContents, addedCount, removedShells, keptShells := merger.merge(baseShellsFileContents, shellsFileContents, extraShellsFileContents)
 
-	for extraLine := range strings.SplitSeq(string(extraShellsFileContents), "\n") {
-		extraLine := strings.TrimSpace(extraLine)
-		if extraLine == "" {
-			continue
-		}
-		if strings.HasPrefix(extraLine, "#") {
-			continue
-		}
-		if slices.Contains(shellsList, extraLine) {
-			continue
-		}
+	return mergedFileContents, addedCount, removedShells, keptShells, nil
+}
 
-		shellsList = append(shellsList, extraLine)
-		addedCount++
+// planShellsFile merges the shells file of the update into the user's one in upper without writing
+// it, returns the merged contents, or nil if the user has none, and warnings about the shells
+// removed or kept although they don't exist in root
+func planShellsFile(changes ChangeSet, dropped map[string]bool, lowerOld, lowerNew, upper, root string) ([]byte, []error, error) {
+	if !hasUserVersion(changes, dropped, "shells") {
+		return nil, nil, nil
 	}
 
-	mergedFileContents := strings.Join(shellsList, "\n") + "\n"
+	merged, _, removedShells, keptShells, err := mergeShellsFiles(upper, lowerNew, lowerOld, root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't merge lower shells file into upper: %w", err)
+	}
 
-	os.WriteFile(shellsFilePath, []byte(mergedFileContents), 0o644)
+	warnings := []error{}
+	for _, shell := range removedShells {
+		warnings = append(warnings, fmt.Errorf("removed shell %s from shells file since it doesn't exist", shell))
+	}
+	for _, shell := range keptShells {
+		warnings = append(warnings, fmt.Errorf("kept shell %s the user added to the shells file although it doesn't exist", shell))
+	}
 
-	return addedCount, nil
+	return merged, warnings, nil
 }
@@ -2,6 +2,7 @@ package core
 
 import (
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -678,3 +679,214 @@ func TestCleanupSymlink(t *testing.T) {
 		t.Fatal("symlink was cleaned up even though it was different")
 	}
 }
+
+func TestCleanupFolders(t *testing.T) {
+	var err error
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	for _, dir := range []string{"empty/nested", "changed", "user only"} {
+		err = os.MkdirAll(filepath.Join(oldUser, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"empty/nested", "changed"} {
+		err = os.MkdirAll(filepath.Join(newSys, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.Chmod(filepath.Join(oldUser, "changed"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = BuildNewEtc(oldSys, oldUser, newSys, newUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Lstat(filepath.Join(newUser, "empty"))
+	if err == nil {
+		t.Error("empty folder identical to the lower one was not cleaned up")
+	}
+
+	info, err := os.Lstat(filepath.Join(newUser, "changed"))
+	if err != nil {
+		t.Error("folder with changed permissions was cleaned up")
+	} else if info.Mode().Perm() != 0o700 {
+		t.Errorf("Permissions %o instead of %o", info.Mode().Perm(), 0o700)
+	}
+
+	_, err = os.Lstat(filepath.Join(newUser, "user only"))
+	if err != nil {
+		t.Error("folder that only exists in the upper was cleaned up")
+	}
+}
+
+func TestCleanupErrors(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	base := filepath.Join(dir, "base")
+
+	for _, folder := range []string{target, base} {
+		err := os.MkdirAll(folder, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(folder, "file"), []byte("data"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := RemoveIdenticalFiles(target, filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal("cleanup against a missing base failed:", err)
+	}
+
+	err = RemoveIdenticalFiles(filepath.Join(dir, "missing"), base)
+	var cleanupErr *ErrCleanupFiles
+	if !errors.As(err, &cleanupErr) {
+		t.Fatalf("cleanup of a missing target returned %v", err)
+	}
+	var pathErr *CleanupError
+	if !errors.As(err, &pathErr) || pathErr.Path != "." {
+		t.Fatalf("cleanup error doesn't name the path: %v", err)
+	}
+
+	err = RemoveIdenticalFiles(target, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Lstat(filepath.Join(target, "file"))
+	if err == nil {
+		t.Fatal("identical file was not cleaned up")
+	}
+}
+
+// makeUnsearchableFolder creates nested folders in dir whose path is too long to be used,
+// so searching them fails even for root
+func makeUnsearchableFolder(t *testing.T, dir string) {
+	fd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := strings.Repeat("x", 200)
+	for range 25 {
+		err = syscall.Mkdirat(fd, name, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := syscall.Openat(fd, name, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.Close(fd)
+		fd = next
+	}
+	syscall.Close(fd)
+
+	// move every folder up into dir, so RemoveAll can remove them with short paths
+	t.Cleanup(func() {
+		parent := filepath.Join(dir, name)
+		for level := range 24 {
+			moved := filepath.Join(dir, fmt.Sprintf("level%d", level))
+			parentFd, err := syscall.Open(parent, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+			if err != nil {
+				return
+			}
+			err = syscall.Renameat(parentFd, name, atFdCwd, moved)
+			syscall.Close(parentFd)
+			if err != nil {
+				return
+			}
+			parent = moved
+		}
+	})
+}
+
+func TestCleanupUnsearchablePath(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	base := filepath.Join(dir, "base")
+
+	for _, folder := range []string{target, base} {
+		err := os.MkdirAll(folder, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(folder, "file"), []byte("data"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	makeUnsearchableFolder(t, target)
+
+	err := RemoveIdenticalFiles(target, base)
+
+	var pathErr *CleanupError
+	if !errors.As(err, &pathErr) || !strings.HasPrefix(pathErr.Path, strings.Repeat("x", 200)) {
+		t.Errorf("unsearchable path wasn't reported: %v", err)
+	}
+
+	_, err = os.Lstat(filepath.Join(target, "file"))
+	if err == nil {
+		t.Error("identical file wasn't cleaned up because another path can't be searched")
+	}
+}
+
+func TestMergeInShells(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	ours := filepath.Join(dir, "ours")
+	theirs := filepath.Join(dir, "theirs")
+	root := filepath.Join(dir, "root")
+
+	writeFiles(t, map[string]string{
+		filepath.Join(base, "shells"):   "# /etc/shells: valid login shells\n/bin/sh\n/bin/bash\n/bin/zsh\n",
+		filepath.Join(ours, "shells"):   "# /etc/shells: valid login shells\n/bin/sh\n/bin/bash\n\n# my shells\n/bin/zsh\n/usr/bin/fish\n/usr/bin/mine\n",
+		filepath.Join(theirs, "shells"): "# /etc/shells: valid login shells\n# see shells(5)\n/bin/sh\n/bin/bash\n/usr/bin/nu\n/usr/bin/gone\n",
+	})
+	expect := "# /etc/shells: valid login shells\n# see shells(5)\n/bin/sh\n/bin/bash\n/usr/bin/nu\n\n# my shells\n/usr/bin/fish\n/usr/bin/mine\n"
+
+	err := os.MkdirAll(filepath.Join(root, "usr/bin"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("usr/bin", filepath.Join(root, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shell := range []string{"sh", "bash", "nu", "fish"} {
+		err = os.WriteFile(filepath.Join(root, "usr/bin", shell), []byte{}, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	added, removed, kept, err := MergeInShells(ours, theirs, base, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if added != 3 {
+		t.Errorf("added %d lines instead of 3", added)
+	}
+	if !slices.Equal(removed, []string{"/usr/bin/gone"}) {
+		t.Errorf("removed shells are %v", removed)
+	}
+	if !slices.Equal(kept, []string{"/usr/bin/mine"}) {
+		t.Errorf("kept missing shells are %v", kept)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(ours, "shells"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != expect {
+		t.Errorf("merged shells file is\n%s\nexpected\n%s", contents, expect)
+	}
+}
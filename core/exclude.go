@@ -0,0 +1,157 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ExcludeCategory decides how a volatile file that isn't normal configuration is handled
+type ExcludeCategory int
+
+const (
+	// ExcludeSkip leaves the path out completely, like lock files and backups
+	ExcludeSkip ExcludeCategory = iota
+	// ExcludeRegenerate leaves the path out, since the new system has to
+	// regenerate it from its other files, like ld.so.cache
+	ExcludeRegenerate
+	// ExcludeAlwaysKeep always keeps the user's version without comparing or
+	// merging it, since it describes this installation, like machine-id
+	ExcludeAlwaysKeep
+)
+
+func (c ExcludeCategory) String() string {
+	switch c {
+	case ExcludeSkip:
+		return "skip"
+	case ExcludeRegenerate:
+		return "regenerate"
+	case ExcludeAlwaysKeep:
+		return "always-keep"
+	default:
+		return fmt.Sprintf("ExcludeCategory(%d)", int(c))
+	}
+}
+
+// ParseExcludeCategory returns the category with the given name
+func ParseExcludeCategory(name string) (ExcludeCategory, error) {
+	for _, category := range []ExcludeCategory{ExcludeSkip, ExcludeRegenerate, ExcludeAlwaysKeep} {
+		if category.String() == name {
+			return category, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown exclude category %s", name)
+}
+
+// ExcludeRule assigns a category to all paths matching Pattern
+type ExcludeRule struct {
+	// Pattern is matched with path.Match against paths relative to the etc folder,
+	// patterns starting with AnyFolderPrefix are matched against the file name in every folder
+	Pattern  string
+	Category ExcludeCategory
+}
+
+// AnyFolderPrefix makes an exclude pattern match the file name in every folder
+const AnyFolderPrefix = "**/"
+
+// ExcludeRules decides which paths are excluded, the first matching rule wins
+var ExcludeRules = []ExcludeRule{
+	{Pattern: ".pwd.lock", Category: ExcludeSkip},
+	{Pattern: "passwd-", Category: ExcludeSkip},
+	{Pattern: "shadow-", Category: ExcludeSkip},
+	{Pattern: "group-", Category: ExcludeSkip},
+	{Pattern: "gshadow-", Category: ExcludeSkip},
+	{Pattern: "subuid-", Category: ExcludeSkip},
+	{Pattern: "subgid-", Category: ExcludeSkip},
+	// dpkg leaves backups next to the configuration files of every package
+	{Pattern: AnyFolderPrefix + "*.dpkg-old", Category: ExcludeSkip},
+	{Pattern: AnyFolderPrefix + "*.dpkg-bak", Category: ExcludeSkip},
+	{Pattern: "ld.so.cache", Category: ExcludeRegenerate},
+	{Pattern: "mtab", Category: ExcludeRegenerate},
+	{Pattern: "udev/hwdb.bin", Category: ExcludeRegenerate},
+	{Pattern: "machine-id", Category: ExcludeAlwaysKeep},
+	{Pattern: "hostname", Category: ExcludeAlwaysKeep},
+	{Pattern: "adjtime", Category: ExcludeAlwaysKeep},
+	// marks the last update of etc for ConditionNeedsUpdate, its modification time matters
+	{Pattern: ".updated", Category: ExcludeAlwaysKeep},
+}
+
+// NewExcludeRule checks pattern and returns a rule assigning category to it
+func NewExcludeRule(pattern string, category ExcludeCategory) (ExcludeRule, error) {
+	_, err := path.Match(strings.TrimPrefix(pattern, AnyFolderPrefix), "")
+	if err != nil {
+		return ExcludeRule{}, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+
+	return ExcludeRule{Pattern: pattern, Category: category}, nil
+}
+
+// ExcludeCategoryFor returns the category of the first rule of ExcludeRules matching the
+// relative path, paths inside an excluded folder get the category of the folder
+func ExcludeCategoryFor(relativePath string) (ExcludeCategory, bool) {
+	return excludeCategoryIn(ExcludeRules, relativePath)
+}
+
+func excludeCategoryIn(rules []ExcludeRule, relativePath string) (ExcludeCategory, bool) {
+	for current := relativePath; current != "." && current != "/"; current = path.Dir(current) {
+		for _, rule := range rules {
+			if matchesExcludePattern(rule.Pattern, current) {
+				return rule.Category, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func matchesExcludePattern(pattern, relativePath string) bool {
+	if namePattern, ok := strings.CutPrefix(pattern, AnyFolderPrefix); ok {
+		return matchesPattern(namePattern, path.Base(relativePath))
+	}
+
+	return matchesPattern(pattern, relativePath)
+}
+
+// isExcluded checks if relativePath is excluded with any category
+func isExcluded(relativePath string) bool {
+	_, excluded := ExcludeCategoryFor(relativePath)
+	return excluded
+}
+
+// isLeftOut checks if relativePath is excluded in a category that isn't copied
+func isLeftOut(relativePath string) bool {
+	category, excluded := ExcludeCategoryFor(relativePath)
+	return excluded && category != ExcludeAlwaysKeep
+}
+
+// buildRules decides how a build handles each path
+type buildRules struct {
+	policy *Policy
+	// merge and exclude are the rules of the build options followed by the global defaults
+	merge   []MergeRule
+	exclude []ExcludeRule
+}
+
+func (r *buildRules) excludeCategory(relativePath string) (ExcludeCategory, bool) {
+	return excludeCategoryIn(r.exclude, relativePath)
+}
+
+// effectiveRule returns the rule the policy has for relativePath, paths without
+// a rule are handled according to their exclude category
+func effectiveRule(rules *buildRules, relativePath string) PolicyRule {
+	rule := rules.policy.RuleFor(relativePath)
+	if rule.Action != PolicyDefault {
+		return rule
+	}
+
+	category, excluded := rules.excludeCategory(relativePath)
+	switch {
+	case !excluded:
+		return rule
+	case category == ExcludeAlwaysKeep:
+		return PolicyRule{Action: PolicyKeepUser}
+	default:
+		return PolicyRule{Action: PolicyIgnore}
+	}
+}
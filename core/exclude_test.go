@@ -0,0 +1,166 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExcludeCategoryFor(t *testing.T) {
+	rule, err := NewExcludeRule("cache/*", ExcludeSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewExcludeRule("[", ExcludeSkip)
+	if err == nil {
+		t.Error("invalid pattern was accepted")
+	}
+
+	options := DefaultBuildOptions()
+	options.ExcludeRules = []ExcludeRule{rule}
+	rules := options.rules()
+
+	tests := []struct {
+		path     string
+		category ExcludeCategory
+		excluded bool
+	}{
+		{"machine-id", ExcludeAlwaysKeep, true},
+		{"ld.so.cache", ExcludeRegenerate, true},
+		{"shadow-", ExcludeSkip, true},
+		// patterns with the any folder prefix match in every folder
+		{"apt/sources.list.dpkg-old", ExcludeSkip, true},
+		{"sources.list.dpkg-old", ExcludeSkip, true},
+		// others only match the full path
+		{"hwdb.bin", 0, false},
+		{"NetworkManager/hostname", 0, false},
+		{"conf.d/adjtime", 0, false},
+		{"udev/hwdb.bin", ExcludeRegenerate, true},
+		// contents of excluded folders are excluded as well
+		{"cache/fonts/a.cache", ExcludeSkip, true},
+		{"shadow", 0, false},
+	}
+
+	for _, test := range tests {
+		category, excluded := rules.excludeCategory(test.path)
+		if excluded != test.excluded || category != test.category {
+			t.Errorf("%s is excluded %t as %s instead of %t as %s", test.path, excluded, category, test.excluded, test.category)
+		}
+	}
+
+	_, excluded := ExcludeCategoryFor("cache/fonts/a.cache")
+	if excluded {
+		t.Error("exclude rule of the build options changed the global rules")
+	}
+}
+
+func TestCopyAndCleanupExcludes(t *testing.T) {
+	from := t.TempDir()
+	to := filepath.Join(t.TempDir(), "etc")
+
+	for _, file := range []string{"passwd", "passwd-", ".pwd.lock", "ld.so.cache", "machine-id"} {
+		err := os.WriteFile(filepath.Join(from, file), []byte(file), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := CarbonCopyRecursive(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := []string{}
+	for _, entry := range entries {
+		copied = append(copied, entry.Name())
+	}
+	if !slices.Equal(copied, []string{"machine-id", "passwd"}) {
+		t.Errorf("copied %v", copied)
+	}
+
+	err = RemoveIdenticalFiles(to, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Lstat(filepath.Join(to, "machine-id"))
+	if err != nil {
+		t.Error("machine-id was removed although it is always kept")
+	}
+	_, err = os.Lstat(filepath.Join(to, "passwd"))
+	if err == nil {
+		t.Error("identical passwd was not removed")
+	}
+}
+
+func TestBuildExcludes(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	files := map[string]string{
+		filepath.Join(oldUser, "passwd-"):        passwdUpperOld,
+		filepath.Join(oldSys, "ld.so.cache"):     "old cache",
+		filepath.Join(newSys, "ld.so.cache"):     "new cache",
+		filepath.Join(oldUser, "ld.so.cache"):    "user cache",
+		filepath.Join(oldSys, "machine-id"):      "0123456789abcdef0123456789abcdef\n",
+		filepath.Join(newSys, "machine-id"):      "fedcba9876543210fedcba9876543210\n",
+		filepath.Join(oldUser, "machine-id"):     "0123456789abcdef0123456789abcdef\n",
+		filepath.Join(oldUser, "adjtime"):        "0.0 0 0.0\n0\nUTC\n",
+		filepath.Join(newSys, "adjtime"):         "0.0 0 0.0\n0\nUTC\n",
+		filepath.Join(oldUser, "apt/a.dpkg-old"): "backup\n",
+		filepath.Join(oldUser, "apt/a.list"):     "deb mine\n",
+	}
+	writeFiles(t, files)
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"passwd-", "ld.so.cache", "apt/a.dpkg-old"} {
+		_, err = os.Lstat(filepath.Join(newUser, path))
+		if err == nil {
+			t.Errorf("%s was carried into the new upper", path)
+		}
+	}
+
+	// machine-id is unmodified and adjtime identical to the new lower, but both are kept
+	for _, path := range []string{"machine-id", "adjtime", "apt/a.list"} {
+		contents, err := os.ReadFile(filepath.Join(newUser, path))
+		if err != nil {
+			t.Fatalf("%s was not kept: %s", path, err)
+		}
+		if string(contents) != files[filepath.Join(oldUser, path)] {
+			t.Errorf("%s was changed to %s", path, contents)
+		}
+	}
+
+	if !slices.Equal(report.Regenerate, []string{"ld.so.cache"}) {
+		t.Errorf("paths to regenerate are %v", report.Regenerate)
+	}
+	if len(report.StaleShadows) != 0 || len(report.Conflicts) != 0 {
+		t.Errorf("excluded paths are reported: %v %v", report.StaleShadows, report.Conflicts)
+	}
+
+	// an explicit policy wins over the exclude lists
+	policy, err := ParsePolicy(strings.NewReader("machine-id take-upstream\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultBuildOptions()
+	options.Policy = policy
+
+	_, err = BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Lstat(filepath.Join(newUser, "machine-id"))
+	if err == nil {
+		t.Error("policy rule didn't override the exclude list")
+	}
+}
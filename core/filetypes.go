@@ -1,15 +1,19 @@
 package core
 
 import (
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"os"
 	"syscall"
-	"time"
+	"unsafe"
 )
 
-type Symlink struct{}
+type Symlink struct {
+	// Location is the path of the symlink on the running system, like /etc/localtime.
+	// If set, relative and absolute targets pointing to the same path are identical.
+	Location string
+}
 
 func (s *Symlink) SupportsFile(info os.FileInfo) bool {
 	return info.Mode()&os.ModeSymlink != 0
@@ -30,6 +34,18 @@ func (s *Symlink) Copy(fromInfo os.FileInfo, from, to string) error {
 }
 
 func (s *Symlink) CopyAttributes(fromInfo os.FileInfo, to string) error {
+	fromInfoUnix := fromInfo.Sys().(*syscall.Stat_t)
+
+	err := syscall.Lchown(to, int(fromInfoUnix.Uid), int(fromInfoUnix.Gid))
+	if err != nil {
+		return fmt.Errorf("can't change owner: %w", err)
+	}
+
+	err = copyTimes(fromInfo, to, atSymlinkNofollow)
+	if err != nil {
+		return fmt.Errorf("can't change times: %w", err)
+	}
+
 	return nil
 }
 
@@ -44,7 +60,7 @@ func (s *Symlink) IsIdentical(a, b os.FileInfo, aPath, bPath string) (bool, erro
 		return false, err
 	}
 
-	return aTarget == bTarget, nil
+	return normalizeSymlinkTarget(s.Location, aTarget) == normalizeSymlinkTarget(s.Location, bTarget), nil
 }
 
 type Folder struct{}
@@ -74,7 +90,10 @@ func (f *Folder) IsIdentical(a, b os.FileInfo, aPath, bPath string) (bool, error
 	return compareAttributes(a, b), nil
 }
 
-type RegularFile struct{}
+type RegularFile struct {
+	// Digests is used to compare contents if set, otherwise files are compared byte by byte
+	Digests *DigestCache
+}
 
 func (f *RegularFile) SupportsFile(info os.FileInfo) bool {
 	return info.Mode().IsRegular()
@@ -93,7 +112,7 @@ func (f *RegularFile) Copy(fromInfo os.FileInfo, from, to string) error {
 	}
 	defer toFile.Close()
 
-	_, err = io.Copy(toFile, fromFile)
+	err = copySparse(fromFile, toFile, fromInfo.Size())
 	if err != nil {
 		return fmt.Errorf("can't copy data: %w", err)
 	}
@@ -101,6 +120,49 @@ func (f *RegularFile) Copy(fromInfo os.FileInfo, from, to string) error {
 	return nil
 }
 
+// lseek whence values for finding data and holes in sparse files, see lseek(2)
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// copySparse copies size bytes from one file to another while keeping
+// holes in the source as holes in the destination. Falls back to a
+// plain copy if the filesystem can't report holes.
+func copySparse(from, to *os.File, size int64) error {
+	var offset int64
+
+	for offset < size {
+		dataStart, err := from.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// only a hole is left until the end of the file
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) && offset == 0 {
+			_, err = io.Copy(to, from)
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("can't find data: %w", err)
+		}
+
+		dataEnd, err := from.Seek(dataStart, seekHole)
+		if err != nil {
+			return fmt.Errorf("can't find hole: %w", err)
+		}
+
+		_, err = io.Copy(io.NewOffsetWriter(to, dataStart), io.NewSectionReader(from, dataStart, dataEnd-dataStart))
+		if err != nil {
+			return err
+		}
+
+		offset = dataEnd
+	}
+
+	// extends the file if it ends in a hole
+	return to.Truncate(size)
+}
+
 func (f *RegularFile) CopyAttributes(fromInfo os.FileInfo, to string) error {
 	return copyAttributes(fromInfo, to)
 }
@@ -114,16 +176,15 @@ func (f *RegularFile) IsIdentical(a, b os.FileInfo, aPath, bPath string) (bool,
 		return false, nil
 	}
 
-	checkA, err := calculateChecksum(aPath)
-	if err != nil {
-		return false, err
+	if a.Size() != b.Size() {
+		return false, nil
 	}
-	checkB, err := calculateChecksum(bPath)
-	if err != nil {
-		return false, err
+
+	if f.Digests != nil {
+		return f.Digests.Identical(a, b, aPath, bPath)
 	}
 
-	return checkA == checkB, nil
+	return contentsIdentical(aPath, bPath)
 }
 
 type CharDeviceFile struct{}
@@ -162,8 +223,6 @@ func (f *CharDeviceFile) IsIdentical(a, b os.FileInfo, aPath, bPath string) (boo
 	return aInfoUnix.Rdev == bInfoUnix.Rdev, nil
 }
 
-var allATime = time.Now()
-
 func copyAttributes(fromInfo os.FileInfo, to string) error {
 	fromInfoUnix := fromInfo.Sys().(*syscall.Stat_t)
 
@@ -177,9 +236,37 @@ func copyAttributes(fromInfo os.FileInfo, to string) error {
 		return fmt.Errorf("can't change permissions: %w", err)
 	}
 
-	err = os.Chtimes(to, allATime, fromInfo.ModTime())
+	err = copyTimes(fromInfo, to, 0)
+	if err != nil {
+		return fmt.Errorf("can't change times: %w", err)
+	}
+
+	return nil
+}
+
+// utimensat(2) flags and the special directory fd, not exported by syscall
+const (
+	atFdCwd           = -0x64
+	atSymlinkNofollow = 0x100
+)
+
+// copyTimes sets the access and modification time of to to the ones
+// of fromInfo with nanosecond precision.
+//
+// pass atSymlinkNofollow as flags to change the times of a symlink itself
+func copyTimes(fromInfo os.FileInfo, to string, flags int) error {
+	fromInfoUnix := fromInfo.Sys().(*syscall.Stat_t)
+	times := [2]syscall.Timespec{fromInfoUnix.Atim, fromInfoUnix.Mtim}
+
+	toPtr, err := syscall.BytePtrFromString(to)
 	if err != nil {
-		return fmt.Errorf("can't change mod time: %w", err)
+		return err
+	}
+
+	dirFd := atFdCwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirFd), uintptr(unsafe.Pointer(toPtr)), uintptr(unsafe.Pointer(&times[0])), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return errno
 	}
 
 	return nil
@@ -197,15 +284,3 @@ func compareAttributes(a, b os.FileInfo) bool {
 
 	return aPerm == bPerm && aUid == bUid && aGid == bGid
 }
-
-func calculateChecksum(file string) (uint32, error) {
-	calculator := crc32.NewIEEE()
-	osFile, err := os.Open(file)
-	if err != nil {
-		return 0, err
-	}
-	if _, err := io.Copy(calculator, osFile); err != nil {
-		return 0, err
-	}
-	return calculator.Sum32(), nil
-}
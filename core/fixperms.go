@@ -2,57 +2,73 @@ package core
 
 import (
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
 	"syscall"
 )
 
 func ApplyOwnerMappingRecursive(dir string, uidMapping map[int]int, gidMapping map[int]int) error {
-	return applyOwnerMappingRecursive(dir, uidMapping, gidMapping, syscall.Chown)
+	return applyOwnerMappingRecursive(dir, uidMapping, gidMapping, syscall.Chown, 0)
 }
 
-func applyOwnerMappingRecursive(dir string, uidMapping map[int]int, gidMapping map[int]int, chownFn func(string, int, int) error) error {
-	err := fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return fmt.Errorf("can't search path \"%s\": %w", path, err)
-		}
+func applyOwnerMappingRecursive(dir string, uidMapping map[int]int, gidMapping map[int]int, chownFn func(string, int, int) error, concurrency int) error {
+	entries, err := walkTree(dir)
+	if err != nil {
+		return fmt.Errorf("can't apply ownership: %w", err)
+	}
+
+	changed := make([]bool, len(entries))
+	errs := forEachParallel(len(entries), concurrency, func(i int) error {
+		path := entries[i].path
 
-		err = applyOwnerMapping(filepath.Join(dir, path), uidMapping, gidMapping, chownFn)
+		isChanged, err := applyOwnerMapping(filepath.Join(dir, path), uidMapping, gidMapping, chownFn)
 		if err != nil {
 			return fmt.Errorf("can't apply ownership of %s: %w", path, err)
 		}
+		changed[i] = isChanged
 
 		return nil
 	})
 
+	// report in walk order instead of the order the workers finished in
+	for i, entry := range entries {
+		if changed[i] {
+			fmt.Println("changing ownership of:", filepath.Join(dir, entry.path))
+		}
+	}
+
+	err = firstError(errs)
 	if err != nil {
-		return fmt.Errorf("can't copy all files: %w", err)
+		return fmt.Errorf("can't apply ownership: %w", err)
 	}
 
 	return nil
 }
 
 func ApplyOwnerMapping(path string, uidMapping map[int]int, gidMapping map[int]int) error {
-	return applyOwnerMapping(path, uidMapping, gidMapping, syscall.Chown)
+	_, err := applyOwnerMapping(path, uidMapping, gidMapping, syscall.Chown)
+	return err
 }
 
-func applyOwnerMapping(path string, uidMapping map[int]int, gidMapping map[int]int, chownFn func(string, int, int) error) error {
+// applyOwnerMapping changes the owner of path according to the mappings
+// and returns whether it had to be changed
+func applyOwnerMapping(path string, uidMapping map[int]int, gidMapping map[int]int, chownFn func(string, int, int) error) (bool, error) {
 	info, err := os.Lstat(path)
 	if err != nil {
-		return fmt.Errorf("can't get info about file: %w", err)
+		return false, fmt.Errorf("can't get info about file: %w", err)
 	}
 
 	if isSymlink(info) {
-		return nil
+		return false, nil
 	}
 
 	infoUnix := info.Sys().(*syscall.Stat_t)
 
+	// ids without a mapping are kept, only the mapped one of uid and gid changes
 	oldUid := int(infoUnix.Uid)
 	newUid, ok := uidMapping[oldUid]
 	if !ok {
-		oldUid = newUid
+		newUid = oldUid
 	}
 
 	oldGid := int(infoUnix.Gid)
@@ -62,17 +78,15 @@ func applyOwnerMapping(path string, uidMapping map[int]int, gidMapping map[int]i
 	}
 
 	if newUid == oldUid && newGid == oldGid {
-		return nil
+		return false, nil
 	}
 
-	fmt.Println("changing ownership of:", path)
-
 	err = chownFn(path, newUid, newGid)
 	if err != nil {
-		return fmt.Errorf("can't change owner: %w", err)
+		return false, fmt.Errorf("can't change owner: %w", err)
 	}
 
-	return nil
+	return true, nil
 }
 
 func isSymlink(info os.FileInfo) bool {
@@ -3,6 +3,7 @@ package core
 import (
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 )
 
@@ -19,8 +20,54 @@ func TestNoop(t *testing.T) {
 	err = applyOwnerMappingRecursive(dir, map[int]int{}, map[int]int{}, func(path string, uid, gid int) error {
 		t.Fatal("changed file", path, "even though no mapping was set")
 		return nil
-	})
+	}, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestOnlyGidMapped(t *testing.T) {
+	dir := t.TempDir()
+
+	testfile := filepath.Join(dir, "file")
+
+	err := os.WriteFile(testfile, []byte("test content"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a uid other than 0, so it can't be mistaken for one that was reset
+	err = os.Chown(testfile, 4321, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(testfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := int(info.Sys().(*syscall.Stat_t).Uid)
+	gid := int(info.Sys().(*syscall.Stat_t).Gid)
+
+	// the uid has no mapping, so it has to be kept instead of becoming 0
+	changed := false
+	err = applyOwnerMappingRecursive(dir, map[int]int{uid + 1: uid + 2}, map[int]int{gid: gid + 1000}, func(path string, newUid, newGid int) error {
+		if path != testfile {
+			return nil
+		}
+		changed = true
+		if newUid != uid {
+			t.Errorf("uid of %s was changed from %d to %d without a mapping", path, uid, newUid)
+		}
+		if newGid != gid+1000 {
+			t.Errorf("gid of %s was changed to %d instead of %d", path, newGid, gid+1000)
+		}
+		return nil
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("owner of the file wasn't changed")
+	}
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles writes the contents of every file with mode 0644,
+// the folders they are in are created if necessary
+func writeFiles(t *testing.T, files map[string]string) {
+	for file, contents := range files {
+		err := os.MkdirAll(filepath.Dir(file), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(file, []byte(contents), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// chmodFiles changes the mode of every file
+func chmodFiles(t *testing.T, modes map[string]os.FileMode) {
+	for file, mode := range modes {
+		err := os.Chmod(file, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// HostsMerger merges /etc/hosts files.
+//
+// The file is treated as a set of mappings from an address to a hostname, so
+// names the update added to an address are added and names it removed are
+// removed, no matter on which line the user put them. New names for an address
+// the user already has are added to the user's first line for it, only addresses
+// the user doesn't have get a new line. The user's lines and comments are kept
+// as they are unless names have to be added to or removed from them.
+//
+// If the update maps a name to an address of the same family the user mapped
+// it to a different address, the user's mapping is kept and a conflict is reported.
+type HostsMerger struct{}
+
+type hostsLine struct {
+	// address is empty for comments and empty lines
+	address string
+	names   []string
+	comment string
+	raw     string
+}
+
+func parseHosts(contents []byte) []hostsLine {
+	lines := []hostsLine{}
+
+	if len(contents) == 0 {
+		return lines
+	}
+
+	for raw := range strings.SplitSeq(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		line := hostsLine{raw: raw}
+
+		entry, comment, hasComment := strings.Cut(raw, "#")
+		if hasComment {
+			line.comment = "#" + comment
+		}
+
+		fields := strings.Fields(entry)
+		if len(fields) >= 2 {
+			line.address = fields[0]
+			line.names = fields[1:]
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// hostsMappings returns all address and name pairs
+func hostsMappings(lines []hostsLine) map[string]bool {
+	mappings := make(map[string]bool)
+
+	for _, line := range lines {
+		for _, name := range line.names {
+			mappings[hostsMapping(line.address, name)] = true
+		}
+	}
+
+	return mappings
+}
+
+func hostsMapping(address, name string) string {
+	return address + " " + name
+}
+
+// hostsNameKey identifies a name per address family, since
+// a name may have both an IPv4 and an IPv6 address
+func hostsNameKey(address, name string) string {
+	if strings.Contains(address, ":") {
+		return "ipv6 " + name
+	}
+
+	return "ipv4 " + name
+}
+
+func (l hostsLine) format() string {
+	separator := " "
+	if strings.Contains(l.raw, "\t") {
+		separator = "\t"
+	}
+
+	formatted := l.address + separator + strings.Join(l.names, " ")
+	if l.comment != "" {
+		formatted += " " + l.comment
+	}
+
+	return formatted
+}
+
+func (m *HostsMerger) Merge(base, ours, theirs []byte) ([]byte, []Conflict, error) {
+	baseMappings := hostsMappings(parseHosts(base))
+	oursLines := parseHosts(ours)
+	oursMappings := hostsMappings(oursLines)
+	theirsLines := parseHosts(theirs)
+	theirsMappings := hostsMappings(theirsLines)
+
+	conflicts := []Conflict{}
+	merged := []hostsLine{}
+	addresses := make(map[string]string)
+
+	for _, line := range oursLines {
+		if line.address == "" {
+			merged = append(merged, line)
+			continue
+		}
+
+		names := slices.DeleteFunc(slices.Clone(line.names), func(name string) bool {
+			mapping := hostsMapping(line.address, name)
+			return baseMappings[mapping] && !theirsMappings[mapping]
+		})
+
+		if len(names) == 0 {
+			// all names were removed by the update
+			continue
+		}
+
+		if len(names) != len(line.names) {
+			line.names = names
+			line.raw = line.format()
+		}
+
+		for _, name := range names {
+			addresses[hostsNameKey(line.address, name)] = line.address
+		}
+
+		merged = append(merged, line)
+	}
+
+	for index, line := range theirsLines {
+		if line.address == "" {
+			continue
+		}
+
+		newNames := []string{}
+
+		for _, name := range line.names {
+			mapping := hostsMapping(line.address, name)
+			if baseMappings[mapping] || oursMappings[mapping] {
+				continue
+			}
+
+			nameKey := hostsNameKey(line.address, name)
+			if address, ok := addresses[nameKey]; ok && address != line.address {
+				conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("%s is mapped to %s by the user and to %s by the update", name, address, line.address)})
+				continue
+			}
+
+			addresses[nameKey] = line.address
+			newNames = append(newNames, name)
+		}
+
+		if len(newNames) == 0 {
+			continue
+		}
+
+		if existing := slices.IndexFunc(merged, func(mergedLine hostsLine) bool { return mergedLine.address == line.address }); existing >= 0 {
+			merged[existing].names = append(slices.Clone(merged[existing].names), newNames...)
+			merged[existing].raw = merged[existing].format()
+			continue
+		}
+
+		if len(newNames) != len(line.names) {
+			line.names = newNames
+			line.raw = line.format()
+		}
+
+		merged = slices.Insert(merged, hostsInsertPosition(merged, theirsLines, index), line)
+	}
+
+	rawLines := make([]string, len(merged))
+	for i, line := range merged {
+		rawLines[i] = line.raw
+	}
+
+	if len(rawLines) == 0 {
+		return []byte{}, conflicts, nil
+	}
+
+	return []byte(strings.Join(rawLines, "\n") + "\n"), conflicts, nil
+}
+
+// hostsInsertPosition finds the position for a line of the update in merged,
+// after the last line for the closest preceding address of the update
+func hostsInsertPosition(merged, theirsLines []hostsLine, index int) int {
+	for before := index; before >= 0; before-- {
+		address := theirsLines[before].address
+		if address == "" {
+			continue
+		}
+
+		for position := len(merged) - 1; position >= 0; position-- {
+			if merged[position].address == address {
+				return position + 1
+			}
+		}
+	}
+
+	return len(merged)
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// IdentityValidators check the format of the files describing the identity of an installation.
+// These files are always kept from the upper, see ExcludeRules, so broken versions are only reported.
+var IdentityValidators = map[string]func(contents []byte) error{
+	"machine-id": ValidateMachineID,
+	"hostname":   ValidateHostname,
+}
+
+// ValidateMachineID checks that contents is a machine-id as described in machine-id(5):
+// 32 lowercase hexadecimal characters, or empty or uninitialized before the first boot
+func ValidateMachineID(contents []byte) error {
+	id := strings.TrimSuffix(string(contents), "\n")
+
+	if id == "" || id == "uninitialized" {
+		return nil
+	}
+
+	if len(id) != 32 {
+		return fmt.Errorf("machine-id has %d characters instead of 32", len(id))
+	}
+	if strings.Trim(id, "0123456789abcdef") != "" {
+		return errors.New("machine-id contains characters that aren't lowercase hexadecimal")
+	}
+	if strings.Trim(id, "0") == "" {
+		return errors.New("machine-id is all zeros")
+	}
+
+	return nil
+}
+
+// ValidateHostname checks that contents is a hostname file as described in hostname(5):
+// a single hostname of at most 64 characters, made of letters, digits and hyphens
+// separated by dots. Lines starting with # are ignored.
+func ValidateHostname(contents []byte) error {
+	hostnames := []string{}
+	for _, line := range splitLines(string(contents)) {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			hostnames = append(hostnames, line)
+		}
+	}
+
+	switch {
+	case len(hostnames) == 0:
+		// an empty hostname uses the fallback hostname
+		return nil
+	case len(hostnames) > 1:
+		return errors.New("hostname contains more than one hostname")
+	}
+
+	hostname := hostnames[0]
+	if len(hostname) > 64 {
+		return fmt.Errorf("hostname %s is longer than 64 characters", hostname)
+	}
+
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("hostname %s contains an invalid label %q", hostname, label)
+		}
+		if strings.Trim(strings.ToLower(label), "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return fmt.Errorf("hostname %s contains invalid characters", hostname)
+		}
+	}
+
+	return nil
+}
+
+// validateIdentityFiles checks the identity files of the new upper
+// with IdentityValidators and returns all problems found
+func validateIdentityFiles(upperNew string) []error {
+	problems := []error{}
+
+	for _, path := range slices.Sorted(maps.Keys(IdentityValidators)) {
+		// symlinks like machine-id pointing to /run can't be checked here
+		if !isRegularFile(filepath.Join(upperNew, path)) {
+			continue
+		}
+
+		contents, err := os.ReadFile(filepath.Join(upperNew, path))
+		if err != nil {
+			problems = append(problems, fmt.Errorf("can't check %s: %w", path, err))
+			continue
+		}
+
+		err = IdentityValidators[path](contents)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("kept invalid %s: %w", path, err))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateMachineID(t *testing.T) {
+	valid := []string{"4c4c4544004a3510804cb4c04f4e4d32\n", "4c4c4544004a3510804cb4c04f4e4d32", "uninitialized\n", ""}
+	invalid := []string{"4C4C4544004A3510804CB4C04F4E4D32\n", "4c4c4544-004a-3510-804c-b4c04f4e4d32\n", "00000000000000000000000000000000\n", "abc\n", "\n\n"}
+
+	for _, id := range valid {
+		err := ValidateMachineID([]byte(id))
+		if err != nil {
+			t.Errorf("valid machine-id %q was rejected: %s", id, err)
+		}
+	}
+	for _, id := range invalid {
+		err := ValidateMachineID([]byte(id))
+		if err == nil {
+			t.Errorf("invalid machine-id %q was accepted", id)
+		}
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	valid := []string{"laptop\n", "# set by the installer\nbuild-01.example.org\n", "", "A1\n"}
+	invalid := []string{"laptop\ndesktop\n", "-laptop\n", "my_laptop\n", "laptop..example\n", strings.Repeat("a", 65) + "\n"}
+
+	for _, hostname := range valid {
+		err := ValidateHostname([]byte(hostname))
+		if err != nil {
+			t.Errorf("valid hostname %q was rejected: %s", hostname, err)
+		}
+	}
+	for _, hostname := range invalid {
+		err := ValidateHostname([]byte(hostname))
+		if err == nil {
+			t.Errorf("invalid hostname %q was accepted", hostname)
+		}
+	}
+}
+
+func TestIdentityFilesKept(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	files := map[string]string{
+		// the image ships an uninitialized machine-id and the user's is still the same
+		filepath.Join(oldSys, "machine-id"):  "uninitialized\n",
+		filepath.Join(newSys, "machine-id"):  "uninitialized\n",
+		filepath.Join(oldUser, "machine-id"): "uninitialized\n",
+		// the user's hostname is an unmodified copy, but still the identity of the machine
+		filepath.Join(oldSys, "hostname"):  "localhost\n",
+		filepath.Join(newSys, "hostname"):  "fedora\n",
+		filepath.Join(oldUser, "hostname"): "localhost\n",
+		filepath.Join(oldUser, ".updated"): "TIMESTAMP_NSEC=1700000000000000000\n",
+	}
+	writeFiles(t, files)
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"machine-id", "hostname", ".updated"} {
+		contents, err := os.ReadFile(filepath.Join(newUser, path))
+		if err != nil {
+			t.Fatalf("%s was not kept: %s", path, err)
+		}
+		if string(contents) != files[filepath.Join(oldUser, path)] {
+			t.Errorf("%s was changed to %s", path, contents)
+		}
+	}
+	if len(report.Warnings) != 0 {
+		t.Errorf("valid identity files have warnings: %v", report.Warnings)
+	}
+
+	// a missing machine-id in the image doesn't matter either, but invalid files are reported
+	err = os.Remove(filepath.Join(newSys, "machine-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(filepath.Join(oldUser, "machine-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(oldUser, "machine-id"), []byte("not a machine id\n"), 0o444)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(newUser, "machine-id"))
+	if err != nil || string(contents) != "not a machine id\n" {
+		t.Errorf("machine-id was not kept: %s %s", contents, err)
+	}
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0].Error(), "machine-id") {
+		t.Errorf("invalid machine-id is not reported: %v", report.Warnings)
+	}
+}
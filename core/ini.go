@@ -0,0 +1,260 @@
+package core
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// IniMerger merges INI style files like systemd units, systemd's *.conf
+// files, dnf.conf or the NetworkManager configuration.
+//
+// Every key of a section is merged on its own like in KeyValueMerger. Keys can
+// appear multiple times in a section like in systemd units, where each line
+// adds to a list, so all lines of a key are taken either from the user or from
+// the update as a whole. Sections can appear multiple times as well, like [Route]
+// in systemd-networkd files, they are matched by their name and the number of
+// sections with that name before them. Sections the update added are inserted
+// after the section preceding them in the update, sections it removed are removed
+// if the user didn't add any keys to them.
+type IniMerger struct {
+	// CommentPrefixes contains all characters that start a comment line
+	CommentPrefixes string
+}
+
+type iniLine struct {
+	// key is empty for comments and empty lines
+	key   string
+	value string
+	raw   string
+}
+
+type iniSection struct {
+	// name is empty for the keys before the first section header
+	name string
+	// id identifies the section, later sections with the same name get their number appended
+	id     string
+	header string
+	lines  []iniLine
+}
+
+func (m *IniMerger) parse(contents []byte) []*iniSection {
+	sections := []*iniSection{{}}
+	occurrences := make(map[string]int)
+
+	if len(contents) == 0 {
+		return sections
+	}
+
+	for raw := range strings.SplitSeq(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		trimmed := strings.TrimSpace(raw)
+		current := sections[len(sections)-1]
+
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			name := strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			id := name
+			occurrences[name]++
+			if occurrences[name] > 1 {
+				id = fmt.Sprintf("%s #%d", name, occurrences[name])
+			}
+
+			sections = append(sections, &iniSection{name: name, id: id, header: raw})
+			continue
+		}
+
+		line := iniLine{raw: raw}
+		if trimmed != "" && !strings.ContainsAny(trimmed[:1], m.CommentPrefixes) {
+			key, value, _ := strings.Cut(trimmed, "=")
+			line.key = strings.TrimSpace(key)
+			line.value = strings.TrimSpace(value)
+		}
+
+		current.lines = append(current.lines, line)
+	}
+
+	return sections
+}
+
+func findIniSection(sections []*iniSection, id string) *iniSection {
+	for _, section := range sections {
+		if section.id == id {
+			return section
+		}
+	}
+
+	return nil
+}
+
+// values returns all values of key joined, so repeated keys are compared as a whole
+func (s *iniSection) values(key string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+
+	values := []string{}
+	for _, line := range s.lines {
+		if line.key == key {
+			values = append(values, line.value)
+		}
+	}
+
+	return strings.Join(values, "\x00"), len(values) != 0
+}
+
+func (s *iniSection) keyLines(key string) []iniLine {
+	lines := []iniLine{}
+	for _, line := range s.lines {
+		if line.key == key {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func (s *iniSection) hasKeys() bool {
+	return slices.ContainsFunc(s.lines, func(line iniLine) bool { return line.key != "" })
+}
+
+func (m *IniMerger) Merge(base, ours, theirs []byte) ([]byte, []Conflict, error) {
+	baseSections := m.parse(base)
+	oursSections := m.parse(ours)
+	theirsSections := m.parse(theirs)
+
+	conflicts := []Conflict{}
+	merged := []*iniSection{}
+
+	for _, oursSection := range oursSections {
+		baseSection := findIniSection(baseSections, oursSection.id)
+		theirsSection := findIniSection(theirsSections, oursSection.id)
+
+		section, sectionConflicts := m.mergeSection(baseSection, oursSection, theirsSection)
+		conflicts = append(conflicts, sectionConflicts...)
+
+		// the update removed the section and the user didn't add anything to it
+		if baseSection != nil && theirsSection == nil && !section.hasKeys() {
+			continue
+		}
+
+		merged = append(merged, section)
+	}
+
+	for index, theirsSection := range theirsSections {
+		if findIniSection(oursSections, theirsSection.id) != nil {
+			continue
+		}
+
+		if baseSection := findIniSection(baseSections, theirsSection.id); baseSection != nil {
+			if !slices.Equal(baseSection.lines, theirsSection.lines) {
+				conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("section %s was removed by the user and changed by the update", theirsSection.id)})
+			}
+			continue
+		}
+
+		position := len(merged)
+		for before := index - 1; before >= 0; before-- {
+			anchor := slices.IndexFunc(merged, func(section *iniSection) bool {
+				return section.id == theirsSections[before].id
+			})
+			if anchor >= 0 {
+				position = anchor + 1
+				break
+			}
+		}
+
+		merged = slices.Insert(merged, position, theirsSection)
+	}
+
+	rawLines := []string{}
+	for _, section := range merged {
+		if section.header != "" {
+			rawLines = append(rawLines, section.header)
+		}
+		for _, line := range section.lines {
+			rawLines = append(rawLines, line.raw)
+		}
+	}
+
+	if len(rawLines) == 0 {
+		return []byte{}, conflicts, nil
+	}
+
+	return []byte(strings.Join(rawLines, "\n") + "\n"), conflicts, nil
+}
+
+func (m *IniMerger) mergeSection(baseSection, oursSection, theirsSection *iniSection) (*iniSection, []Conflict) {
+	conflicts := []Conflict{}
+	merged := &iniSection{name: oursSection.name, id: oursSection.id, header: oursSection.header}
+	decided := make(map[string]bool)
+
+	for _, line := range oursSection.lines {
+		if line.key == "" {
+			merged.lines = append(merged.lines, line)
+			continue
+		}
+
+		oursValue, _ := oursSection.values(line.key)
+		baseValue, inBase := baseSection.values(line.key)
+		theirsValue, inTheirs := theirsSection.values(line.key)
+
+		oursChanged := !inBase || baseValue != oursValue
+		theirsChanged := inBase != inTheirs || (inTheirs && baseValue != theirsValue)
+
+		switch {
+		case !theirsChanged || (inTheirs && theirsValue == oursValue):
+			merged.lines = append(merged.lines, line)
+		case !oursChanged && !inTheirs:
+			// removed by the update
+		case !oursChanged:
+			// all lines of the key are replaced at its first line
+			if !decided[line.key] {
+				merged.lines = append(merged.lines, theirsSection.keyLines(line.key)...)
+			}
+		default:
+			merged.lines = append(merged.lines, line)
+			if !decided[line.key] {
+				conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("key %s in section %s was changed by the user and the update", line.key, oursSection.id)})
+			}
+		}
+
+		decided[line.key] = true
+	}
+
+	if theirsSection == nil {
+		return merged, conflicts
+	}
+
+	// keys the update added go before the empty lines at the end of the section
+	end := len(merged.lines)
+	for end > 0 && strings.TrimSpace(merged.lines[end-1].raw) == "" {
+		end--
+	}
+
+	for index, line := range theirsSection.lines {
+		if line.key == "" || decided[line.key] {
+			continue
+		}
+		decided[line.key] = true
+
+		baseValue, inBase := baseSection.values(line.key)
+		if inBase {
+			theirsValue, _ := theirsSection.values(line.key)
+			if baseValue != theirsValue {
+				conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("key %s in section %s was removed by the user and changed by the update", line.key, oursSection.id)})
+			}
+			continue
+		}
+
+		// take the comments directly above the new key with it
+		firstComment := index
+		for firstComment > 0 && theirsSection.lines[firstComment-1].key == "" && strings.TrimSpace(theirsSection.lines[firstComment-1].raw) != "" {
+			firstComment--
+		}
+
+		added := append(slices.Clone(theirsSection.lines[firstComment:index]), theirsSection.keyLines(line.key)...)
+		merged.lines = slices.Insert(merged.lines, end, added...)
+		end += len(added)
+	}
+
+	return merged, conflicts
+}
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// KeyValueDialect is the way keys and values are separated in a key value file
+type KeyValueDialect int
+
+const (
+	// KeyValueEquals separates keys and values with =, optionally surrounded by spaces
+	KeyValueEquals KeyValueDialect = iota
+	// KeyValueWhitespace separates keys and values with spaces or tabs, like login.defs
+	KeyValueWhitespace
+)
+
+// KeyValueMerger merges files that map keys to values, like login.defs or sysctl.conf.
+//
+// Each key is merged on its own: if only the update changed a key, the updated line is used,
+// if only the user changed it, the user's line is kept. Keys the update added are inserted
+// after the key preceding them in the update, or before the key following them if no key precedes
+// them, together with the comments directly above them that the user doesn't have already.
+// Keys the update removed are removed if the user didn't change them.
+//
+// If the user and the update changed a key differently, the user's line is kept and a
+// conflict is reported. All other lines of the user's file are kept as they are.
+type KeyValueMerger struct {
+	Dialect KeyValueDialect
+	// CommentPrefixes contains all characters that start a comment line
+	CommentPrefixes string
+}
+
+type keyValueLine struct {
+	// key is empty for comments and empty lines
+	key   string
+	value string
+	raw   string
+}
+
+func (m *KeyValueMerger) parse(contents []byte) []keyValueLine {
+	lines := []keyValueLine{}
+
+	if len(contents) == 0 {
+		return lines
+	}
+
+	for raw := range strings.SplitSeq(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		trimmed := strings.TrimSpace(raw)
+		line := keyValueLine{raw: raw}
+
+		if trimmed == "" || strings.ContainsAny(trimmed[:1], m.CommentPrefixes) {
+			lines = append(lines, line)
+			continue
+		}
+
+		switch m.Dialect {
+		case KeyValueEquals:
+			key, value, _ := strings.Cut(trimmed, "=")
+			line.key = strings.TrimSpace(key)
+			line.value = strings.TrimSpace(value)
+		case KeyValueWhitespace:
+			key, value, _ := strings.Cut(trimmed, " ")
+			if tabKey, tabValue, ok := strings.Cut(trimmed, "\t"); ok && len(tabKey) < len(key) {
+				key, value = tabKey, tabValue
+			}
+			line.key = key
+			line.value = strings.TrimSpace(value)
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// keyValues maps keys to their lines, later lines win like in most parsers
+func keyValues(lines []keyValueLine) map[string]keyValueLine {
+	values := make(map[string]keyValueLine)
+
+	for _, line := range lines {
+		if line.key != "" {
+			values[line.key] = line
+		}
+	}
+
+	return values
+}
+
+func (m *KeyValueMerger) Merge(base, ours, theirs []byte) ([]byte, []Conflict, error) {
+	merged, conflicts := mergeKeyedLines(m.parse(base), m.parse(ours), m.parse(theirs), "key")
+	return joinKeyedLines(merged), conflicts, nil
+}
+
+// mergeKeyedLines merges lines identified by their key, see KeyValueMerger for the rules.
+//
+// noun describes what a key is in conflict messages
+func mergeKeyedLines(baseLines, oursLines, theirsLines []keyValueLine, noun string) ([]keyValueLine, []Conflict) {
+	baseValues := keyValues(baseLines)
+	oursValues := keyValues(oursLines)
+	theirsValues := keyValues(theirsLines)
+
+	// comments the user already has or removed, they aren't taken along with new keys
+	knownComments := make(map[string]bool)
+	for _, line := range slices.Concat(baseLines, oursLines) {
+		if line.key == "" {
+			knownComments[strings.TrimSpace(line.raw)] = true
+		}
+	}
+
+	conflicts := []Conflict{}
+	merged := []keyValueLine{}
+
+	for _, line := range oursLines {
+		if line.key == "" {
+			merged = append(merged, line)
+			continue
+		}
+
+		baseLine, inBase := baseValues[line.key]
+		theirsLine, inTheirs := theirsValues[line.key]
+
+		oursChanged := !inBase || baseLine.value != line.value
+		theirsChanged := inBase != inTheirs || (inTheirs && baseLine.value != theirsLine.value)
+
+		switch {
+		case !theirsChanged:
+			merged = append(merged, line)
+		case !oursChanged && !inTheirs:
+			// removed by the update
+		case !oursChanged:
+			merged = append(merged, theirsLine)
+		case inTheirs && theirsLine.value == line.value:
+			merged = append(merged, line)
+		default:
+			merged = append(merged, line)
+			conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("%s %s was changed by the user and the update", noun, line.key)})
+		}
+	}
+
+	for index, line := range theirsLines {
+		if line.key == "" {
+			continue
+		}
+		if _, inOurs := oursValues[line.key]; inOurs {
+			continue
+		}
+
+		if baseLine, inBase := baseValues[line.key]; inBase {
+			if baseLine.value != line.value {
+				conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("%s %s was removed by the user and changed by the update", noun, line.key)})
+			}
+			continue
+		}
+
+		// take the comments directly above the new key with it
+		firstComment := index
+		for firstComment > 0 && theirsLines[firstComment-1].key == "" {
+			comment := strings.TrimSpace(theirsLines[firstComment-1].raw)
+			if comment == "" || knownComments[comment] {
+				break
+			}
+			firstComment--
+		}
+
+		position := -1
+		for before := firstComment - 1; before >= 0 && position < 0; before-- {
+			if theirsLines[before].key == "" {
+				continue
+			}
+
+			anchor := indexOfKey(merged, theirsLines[before].key)
+			if anchor >= 0 {
+				position = anchor + 1
+			}
+		}
+
+		// without a key above it, the new key goes above the next key the user has,
+		// but below the comments the update has between them
+		for after := index + 1; after < len(theirsLines) && position < 0; after++ {
+			if theirsLines[after].key == "" {
+				continue
+			}
+
+			anchor := indexOfKey(merged, theirsLines[after].key)
+			if anchor < 0 {
+				continue
+			}
+
+			between := make(map[string]bool)
+			for _, betweenLine := range theirsLines[index+1 : after] {
+				between[strings.TrimSpace(betweenLine.raw)] = true
+			}
+			for anchor > 0 && merged[anchor-1].key == "" && strings.TrimSpace(merged[anchor-1].raw) != "" && between[strings.TrimSpace(merged[anchor-1].raw)] {
+				anchor--
+			}
+			position = anchor
+		}
+
+		if position < 0 {
+			position = len(merged)
+		}
+
+		merged = slices.Insert(merged, position, theirsLines[firstComment:index+1]...)
+	}
+
+	return merged, conflicts
+}
+
+// indexOfKey returns the index of the line with key in lines or -1
+func indexOfKey(lines []keyValueLine, key string) int {
+	return slices.IndexFunc(lines, func(line keyValueLine) bool {
+		return line.key == key
+	})
+}
+
+func joinKeyedLines(lines []keyValueLine) []byte {
+	if len(lines) == 0 {
+		return []byte{}
+	}
+
+	rawLines := make([]string, len(lines))
+	for i, line := range lines {
+		rawLines[i] = line.raw
+	}
+
+	return []byte(strings.Join(rawLines, "\n") + "\n")
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"slices"
+	"strings"
+)
+
+// LineSetMerger merges files that are unordered sets of lines, like /etc/shells
+// or the files in /etc/ld.so.conf.d.
+//
+// Lines the update added are inserted after the closest line preceding them in
+// the update that the user's file contains as well, lines the update removed are
+// removed from the user's file. Comments are merged the same way and empty lines
+// are kept as they are in the user's file. Lines are compared without surrounding
+// spaces, but written the way they are in the file they are taken from.
+type LineSetMerger struct {
+	// CommentPrefix starts comment lines, comments are never validated
+	CommentPrefix string
+	// Validate is called for every other line of the merged file if set, lines of
+	// the base or the update it returns false for are removed, the user's own are kept
+	Validate func(line string) bool
+}
+
+func (m *LineSetMerger) Merge(base, ours, theirs []byte) ([]byte, []Conflict, error) {
+	merged, _, _, _ := m.merge(base, ours, theirs)
+	return merged, nil, nil
+}
+
+// merge returns the merged contents, the number of lines added from theirs, the invalid
+// lines that were removed and the invalid lines that were kept since only ours has them
+func (m *LineSetMerger) merge(base, ours, theirs []byte) ([]byte, int, []string, []string) {
+	baseLines := splitLines(string(base))
+	theirsLines := splitLines(string(theirs))
+	lines, added := mergeLines(splitRawLines(string(base)), splitRawLines(string(ours)), splitRawLines(string(theirs)))
+
+	removed := []string{}
+	kept := []string{}
+
+	if m.Validate != nil {
+		lines = slices.DeleteFunc(lines, func(rawLine string) bool {
+			line := strings.TrimSpace(rawLine)
+			if line == "" || m.isComment(line) || m.Validate(line) {
+				return false
+			}
+
+			if !slices.Contains(baseLines, line) && !slices.Contains(theirsLines, line) {
+				kept = append(kept, line)
+				return false
+			}
+
+			removed = append(removed, line)
+			return true
+		})
+	}
+
+	return []byte(strings.Join(lines, "\n") + "\n"), added, removed, kept
+}
+
+func (m *LineSetMerger) isComment(line string) bool {
+	return m.CommentPrefix != "" && strings.HasPrefix(line, m.CommentPrefix)
+}
+
+// splitLines splits contents into trimmed lines without the empty line after the last newline
+func splitLines(contents string) []string {
+	lines := splitRawLines(contents)
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+
+	if len(lines) == 1 && lines[0] == "" {
+		return []string{}
+	}
+
+	return lines
+}
+
+// splitRawLines splits contents into lines like splitLines without trimming them
+func splitRawLines(contents string) []string {
+	lines := strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+
+	if len(lines) == 1 && strings.TrimSpace(lines[0]) == "" {
+		return []string{}
+	}
+
+	return lines
+}
+
+// mergeLines merges the lines that were added to or removed from base in theirs into ours.
+//
+// Lines added in theirs are inserted after the closest line preceding them in theirs that
+// is also part of ours, empty lines are kept as they are in ours. Lines are compared
+// trimmed, the merged lines are the untrimmed ones of ours or theirs.
+//
+// returns the merged lines and the number of added lines
+func mergeLines(base, ours, theirs []string) ([]string, int) {
+	baseSet := make(map[string]bool)
+	for _, line := range base {
+		baseSet[strings.TrimSpace(line)] = true
+	}
+	theirsSet := make(map[string]bool)
+	for _, line := range theirs {
+		theirsSet[strings.TrimSpace(line)] = true
+	}
+
+	merged := []string{}
+	mergedSet := make(map[string]bool)
+
+	for _, rawLine := range ours {
+		line := strings.TrimSpace(rawLine)
+		if line != "" && baseSet[line] && !theirsSet[line] {
+			// removed by theirs
+			continue
+		}
+
+		merged = append(merged, rawLine)
+		mergedSet[line] = true
+	}
+
+	added := 0
+
+	for index, rawLine := range theirs {
+		line := strings.TrimSpace(rawLine)
+		if line == "" || baseSet[line] || mergedSet[line] {
+			continue
+		}
+
+		position := len(merged)
+		hasPreceding := false
+
+		for before := index - 1; before >= 0; before-- {
+			preceding := strings.TrimSpace(theirs[before])
+			if preceding == "" {
+				continue
+			}
+			hasPreceding = true
+
+			anchor := slices.IndexFunc(merged, func(mergedLine string) bool {
+				return strings.TrimSpace(mergedLine) == preceding
+			})
+			if anchor >= 0 {
+				position = anchor + 1
+				break
+			}
+		}
+
+		if !hasPreceding {
+			position = 0
+		}
+
+		merged = slices.Insert(merged, position, rawLine)
+		mergedSet[line] = true
+		added++
+	}
+
+	return merged, added
+}
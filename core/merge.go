@@ -0,0 +1,295 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Conflict is a change of the update that couldn't be merged into the user's version
+type Conflict struct {
+	Path   string
+	Reason string
+	// Upstream is the location of the update's version, which is pending review
+	Upstream string
+}
+
+func (c Conflict) String() string {
+	if c.Upstream != "" {
+		return c.Path + ": " + c.Reason + " (update's version: " + c.Upstream + ")"
+	}
+
+	return c.Path + ": " + c.Reason
+}
+
+// Merger merges the changes between two versions of a file into a third one
+type Merger interface {
+	// Merge merges the changes between base, the old lower version, and theirs,
+	// the new lower version, into ours, the user's version.
+	//
+	// Changes that can't be merged are left out of the result in favor of
+	// the user's version and returned as conflicts, the path of which is
+	// filled in by the caller.
+	Merge(base, ours, theirs []byte) ([]byte, []Conflict, error)
+}
+
+var ErrUnknownMergeStrategy = errors.New("unknown merge strategy")
+
+var mergeStrategies = map[string]Merger{
+	"lineset":  &LineSetMerger{CommentPrefix: "#"},
+	"kv":       &KeyValueMerger{Dialect: KeyValueEquals, CommentPrefixes: "#"},
+	"kv-space": &KeyValueMerger{Dialect: KeyValueWhitespace, CommentPrefixes: "#"},
+	"sysctl":   &KeyValueMerger{Dialect: KeyValueEquals, CommentPrefixes: "#;"},
+	"ini":      &IniMerger{CommentPrefixes: "#;"},
+	"fstab":    &TableMerger{Key: fstabKey, KeyName: "mount point", CommentPrefixes: "#"},
+	"crypttab": &TableMerger{Key: crypttabKey, KeyName: "device", CommentPrefixes: "#"},
+	"hosts":    &HostsMerger{},
+	"sudoers":  &SudoersMerger{},
+	"pam":      &PamMerger{},
+	"nsswitch": &NsswitchMerger{},
+}
+
+// RegisterMergeStrategy makes a merger available under name for merge rules
+func RegisterMergeStrategy(name string, merger Merger) {
+	mergeStrategies[name] = merger
+}
+
+// GetMergeStrategy returns the merger registered under name
+func GetMergeStrategy(name string) (Merger, bool) {
+	merger, ok := mergeStrategies[name]
+	return merger, ok
+}
+
+// MergeRule assigns a merge strategy to all paths matching Pattern
+type MergeRule struct {
+	// Pattern is matched with path.Match against paths relative to the etc folder
+	Pattern  string
+	Strategy string
+}
+
+// MergeRules decide which files are merged with which strategy, the first matching rule is used
+var MergeRules = []MergeRule{
+	{Pattern: "ld.so.conf.d/*", Strategy: "lineset"},
+	{Pattern: "securetty", Strategy: "lineset"},
+	{Pattern: "filesystems", Strategy: "lineset"},
+	{Pattern: "ethertypes", Strategy: "lineset"},
+	{Pattern: "environment", Strategy: "kv"},
+	{Pattern: "default/*", Strategy: "kv"},
+	{Pattern: "login.defs", Strategy: "kv-space"},
+	{Pattern: "sysctl.conf", Strategy: "sysctl"},
+	{Pattern: "sysctl.d/*.conf", Strategy: "sysctl"},
+	{Pattern: "systemd/*.conf", Strategy: "ini"},
+	{Pattern: "systemd/*.conf.d/*.conf", Strategy: "ini"},
+	{Pattern: "systemd/system/*.service", Strategy: "ini"},
+	{Pattern: "systemd/system/*.socket", Strategy: "ini"},
+	{Pattern: "systemd/system/*.timer", Strategy: "ini"},
+	{Pattern: "systemd/system/*.d/*.conf", Strategy: "ini"},
+	{Pattern: "NetworkManager/*.conf", Strategy: "ini"},
+	{Pattern: "NetworkManager/conf.d/*.conf", Strategy: "ini"},
+	{Pattern: "dnf/dnf.conf", Strategy: "ini"},
+	{Pattern: "pam_mount.conf", Strategy: "ini"},
+	{Pattern: "fstab", Strategy: "fstab"},
+	{Pattern: "crypttab", Strategy: "crypttab"},
+	{Pattern: "hosts", Strategy: "hosts"},
+	{Pattern: "sudoers", Strategy: "sudoers"},
+	{Pattern: "sudoers.d/*", Strategy: "sudoers"},
+	{Pattern: "pam.d/*", Strategy: "pam"},
+	{Pattern: "nsswitch.conf", Strategy: "nsswitch"},
+}
+
+// NewMergeRule checks pattern and strategy and returns a rule merging paths matching pattern with strategy
+func NewMergeRule(pattern, strategy string) (MergeRule, error) {
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return MergeRule{}, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+
+	_, ok := GetMergeStrategy(strategy)
+	if !ok {
+		return MergeRule{}, fmt.Errorf("%w: %s", ErrUnknownMergeStrategy, strategy)
+	}
+
+	return MergeRule{Pattern: pattern, Strategy: strategy}, nil
+}
+
+// MergerFor returns the merger of the first rule of MergeRules matching the relative path
+func MergerFor(relativePath string) (Merger, bool) {
+	return mergerIn(MergeRules, relativePath)
+}
+
+func mergerIn(rules []MergeRule, relativePath string) (Merger, bool) {
+	for _, rule := range rules {
+		if matchesPattern(rule.Pattern, relativePath) {
+			return GetMergeStrategy(rule.Strategy)
+		}
+	}
+
+	return nil, false
+}
+
+func matchesPattern(pattern, relativePath string) bool {
+	matches, _ := path.Match(pattern, relativePath)
+	return matches
+}
+
+// MergeFiles merges the changes between base and theirs into ours with merger
+// and writes the result to ours, keeping its permissions.
+//
+// base may not exist, in which case theirs is merged as a completely new file.
+// If checker is set and the merged contents differ from ours but don't pass it,
+// ours is kept as it is and a conflict is added to the ones of the merger.
+//
+// returns whether ours was changed and the conflicts of the merge
+func MergeFiles(merger Merger, checker SyntaxChecker, base, ours, theirs string) (bool, []Conflict, error) {
+	merged, changed, conflicts, err := mergeFileContents(merger, checker, base, ours, theirs)
+	if err != nil || !changed {
+		return false, conflicts, err
+	}
+
+	err = os.WriteFile(ours, merged, 0o644)
+	if err != nil {
+		return false, nil, fmt.Errorf("can't write merged file: %w", err)
+	}
+
+	return true, conflicts, nil
+}
+
+// mergeFileContents merges the files like MergeFiles without writing
+// the result, returns the merged contents and if they differ from ours
+func mergeFileContents(merger Merger, checker SyntaxChecker, base, ours, theirs string) ([]byte, bool, []Conflict, error) {
+	baseContents, err := os.ReadFile(base)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil, fmt.Errorf("can't read base file: %w", err)
+	}
+	oursContents, err := os.ReadFile(ours)
+	if err != nil {
+		return nil, false, nil, fmt.Errorf("can't read own file: %w", err)
+	}
+	theirsContents, err := os.ReadFile(theirs)
+	if err != nil {
+		return nil, false, nil, fmt.Errorf("can't read their file: %w", err)
+	}
+
+	merged, conflicts, err := merger.Merge(baseContents, oursContents, theirsContents)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	changed := !bytes.Equal(merged, oursContents)
+	if checker != nil && changed {
+		err = checker(merged)
+		if err != nil {
+			conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("merged version is invalid, keeping the user's version: %s", err)})
+			return nil, false, conflicts, nil
+		}
+	}
+
+	return merged, changed, conflicts, nil
+}
+
+// mergeChangedFiles merges all regular files both the user and the update changed
+// with the merger configured for them, files in handled are left out. Symlinks both
+// changed keep the user's target.
+//
+// The policy can keep the user's version, pick the merge strategy or turn every
+// change of the update into a conflict.
+//
+// Files in bases are merged with the given base instead of the old lower version, even if
+// only the user changed them, since the user's version was based on another version.
+//
+// Nothing is written, the merged contents are returned by path for the files merging changes,
+// together with the conflicts, which includes all files both changed that can't be merged
+func mergeChangedFiles(changes ChangeSet, handled map[string]bool, bases map[string]string, rules *buildRules, lowerOld, lowerNew, upper string) (map[string][]byte, []Conflict, error) {
+	merged := make(map[string][]byte)
+	conflicts := []Conflict{}
+
+	for _, change := range changes {
+		if handled[change.Path] {
+			continue
+		}
+
+		bothChanged := change.Kind == ChangeBothModified || change.Kind == ChangeBothAdded
+		rule := effectiveRule(rules, change.Path)
+
+		oursPath := filepath.Join(upper, change.Path)
+		theirsPath := filepath.Join(lowerNew, change.Path)
+
+		upstream := ""
+		if change.InLowerNew {
+			upstream = theirsPath
+		}
+
+		if rule.Action == PolicyConflictOnChange && (bothChanged || change.IsStaleShadow()) {
+			conflicts = append(conflicts, Conflict{Path: change.Path, Reason: "changed by the update, keeping the user's version as configured", Upstream: upstream})
+			continue
+		}
+		basePath, hasBase := bases[change.Path]
+		if !hasBase {
+			basePath = filepath.Join(lowerOld, change.Path)
+		}
+
+		if !bothChanged && !hasBase {
+			continue
+		}
+
+		switch rule.Action {
+		case PolicyKeepUser, PolicyTakeUpstream, PolicyIgnore:
+			continue
+		}
+
+		merger, ok := mergerForRule(rules, rule, change.Path)
+
+		if rule.Action != PolicyMerge && isSymlinkFile(oursPath) && isSymlinkFile(theirsPath) {
+			// where a symlink points to is a choice of the user, like the time zone
+			// or an alternative, the user's target is checked by findDanglingSymlinks
+			continue
+		}
+
+		if !ok || !change.InLowerNew || !isRegularFile(oursPath) || !isRegularFile(theirsPath) {
+			conflicts = append(conflicts, Conflict{Path: change.Path, Reason: "changed by the user and the update, keeping the user's version", Upstream: upstream})
+			continue
+		}
+
+		checker, _ := SyntaxCheckerFor(change.Path)
+
+		contents, changed, fileConflicts, err := mergeFileContents(merger, checker, basePath, oursPath, theirsPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't merge %s: %w", change.Path, err)
+		}
+
+		for _, conflict := range fileConflicts {
+			conflict.Path = change.Path
+			conflict.Upstream = upstream
+			conflicts = append(conflicts, conflict)
+		}
+
+		if changed {
+			merged[change.Path] = contents
+		}
+	}
+
+	return merged, conflicts, nil
+}
+
+// mergerForRule returns the merger of the strategy the rule merges with,
+// or the one the merge rules configure for path otherwise
+func mergerForRule(rules *buildRules, rule PolicyRule, path string) (Merger, bool) {
+	if rule.Action == PolicyMerge {
+		return GetMergeStrategy(rule.Strategy)
+	}
+
+	return mergerIn(rules.merge, path)
+}
+
+func isRegularFile(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func isSymlinkFile(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && isSymlink(info)
+}
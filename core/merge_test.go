@@ -0,0 +1,490 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type mergeTest struct {
+	name   string
+	base   string
+	ours   string
+	theirs string
+	expect string
+	// conflicts is the number of expected conflicts
+	conflicts int
+}
+
+func runMergeTests(t *testing.T, merger Merger, tests []mergeTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, conflicts, err := merger.Merge([]byte(test.base), []byte(test.ours), []byte(test.theirs))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(merged) != test.expect {
+				t.Errorf("merged file is\n%s\nexpected\n%s", merged, test.expect)
+			}
+			if len(conflicts) != test.conflicts {
+				t.Errorf("%d conflicts instead of %d: %v", len(conflicts), test.conflicts, conflicts)
+			}
+		})
+	}
+}
+
+func TestLineSetMerger(t *testing.T) {
+	runMergeTests(t, &LineSetMerger{CommentPrefix: "#"}, []mergeTest{
+		{
+			name:   "upstream addition after anchor",
+			base:   "/usr/lib\n/usr/local/lib\n",
+			ours:   "/usr/lib\n/opt/mine\n/usr/local/lib\n",
+			theirs: "/usr/lib\n/usr/lib64\n/usr/local/lib\n",
+			expect: "/usr/lib\n/usr/lib64\n/opt/mine\n/usr/local/lib\n",
+		},
+		{
+			name:   "upstream removal",
+			base:   "# libs\n/usr/lib\n/usr/local/lib\n",
+			ours:   "# libs\n/usr/lib\n/usr/local/lib\n/opt/mine\n",
+			theirs: "# libs\n/usr/lib\n",
+			expect: "# libs\n/usr/lib\n/opt/mine\n",
+		},
+		{
+			name:   "user removal stays",
+			base:   "tty1\ntty2\n",
+			ours:   "tty1\n",
+			theirs: "tty1\ntty2\ntty3\n",
+			expect: "tty1\ntty3\n",
+		},
+		{
+			name:   "new comment on top",
+			base:   "ext4\n",
+			ours:   "ext4\nbtrfs\n",
+			theirs: "# filesystems\next4\n",
+			expect: "# filesystems\next4\nbtrfs\n",
+		},
+		{
+			name:   "no base",
+			base:   "",
+			ours:   "a\n",
+			theirs: "a\nb\n",
+			expect: "a\nb\n",
+		},
+		{
+			name:   "indentation kept",
+			base:   "# libs\n  /usr/lib\n",
+			ours:   "# libs\n  /usr/lib\n\t/opt/mine\n",
+			theirs: "# libs\n/usr/lib\n    /usr/lib64\n",
+			expect: "# libs\n  /usr/lib\n    /usr/lib64\n\t/opt/mine\n",
+		},
+	})
+}
+
+func TestMergeRules(t *testing.T) {
+	merger, ok := MergerFor("ld.so.conf.d/libc.conf")
+	if !ok || merger != mergeStrategies["lineset"] {
+		t.Error("ld.so.conf.d files are not merged as line sets")
+	}
+
+	_, ok = MergerFor("ld.so.conf.d/nested/libc.conf")
+	if ok {
+		t.Error("patterns match across folders")
+	}
+
+	rule, err := NewMergeRule("my.conf.d/*", "lineset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultBuildOptions()
+	options.MergeRules = []MergeRule{rule}
+
+	_, ok = mergerForRule(options.rules(), PolicyRule{}, "my.conf.d/a")
+	if !ok {
+		t.Error("merge rule of the build options is not used")
+	}
+	_, ok = MergerFor("my.conf.d/a")
+	if ok {
+		t.Error("merge rule of the build options changed the global rules")
+	}
+
+	_, err = NewMergeRule("other", "no such strategy")
+	if err == nil {
+		t.Error("merge rule with an unknown strategy was accepted")
+	}
+}
+
+func TestMergeChangedFiles(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	files := map[string]string{
+		filepath.Join(oldSys, "ld.so.conf.d/libs.conf"):  "/usr/lib\n",
+		filepath.Join(newSys, "ld.so.conf.d/libs.conf"):  "/usr/lib\n/usr/lib64\n",
+		filepath.Join(oldUser, "ld.so.conf.d/libs.conf"): "/usr/lib\n/opt/lib\n",
+		filepath.Join(oldSys, "unmergeable"):             "a\n",
+		filepath.Join(newSys, "unmergeable"):             "b\n",
+		filepath.Join(oldUser, "unmergeable"):            "c\n",
+	}
+
+	writeFiles(t, files)
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(report.Merged, []string{"ld.so.conf.d/libs.conf"}) {
+		t.Errorf("merged %v", report.Merged)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(newUser, "ld.so.conf.d/libs.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "/usr/lib\n/usr/lib64\n/opt/lib\n" {
+		t.Errorf("merged file is\n%s", contents)
+	}
+
+	if !slices.ContainsFunc(report.Conflicts, func(conflict Conflict) bool { return conflict.Path == "unmergeable" }) {
+		t.Errorf("file without merger is not reported as conflict: %v", report.Conflicts)
+	}
+
+	contents, err = os.ReadFile(filepath.Join(newUser, "unmergeable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "c\n" {
+		t.Error("user's version of a conflicting file was not kept")
+	}
+}
+
+func TestKeyValueMerger(t *testing.T) {
+	runMergeTests(t, &KeyValueMerger{Dialect: KeyValueWhitespace, CommentPrefixes: "#"}, []mergeTest{
+		{
+			name:   "user override kept, upstream change applied",
+			base:   "# login.defs\nUMASK\t\t022\nPASS_MAX_DAYS\t99999\n",
+			ours:   "# login.defs\nUMASK\t\t077\nPASS_MAX_DAYS\t99999\n",
+			theirs: "# login.defs\nUMASK\t\t022\nPASS_MAX_DAYS\t90\n",
+			expect: "# login.defs\nUMASK\t\t077\nPASS_MAX_DAYS\t90\n",
+		},
+		{
+			name:   "upstream added key with comment",
+			base:   "UMASK 022\nENCRYPT_METHOD SHA512\n",
+			ours:   "UMASK 077\nENCRYPT_METHOD SHA512\n",
+			theirs: "UMASK 022\n# use yescrypt\nYESCRYPT_COST_FACTOR 5\nENCRYPT_METHOD YESCRYPT\n",
+			expect: "UMASK 077\n# use yescrypt\nYESCRYPT_COST_FACTOR 5\nENCRYPT_METHOD YESCRYPT\n",
+		},
+		{
+			name:      "both changed",
+			base:      "UMASK 022\n",
+			ours:      "UMASK 077\n",
+			theirs:    "UMASK 027\n",
+			expect:    "UMASK 077\n",
+			conflicts: 1,
+		},
+		{
+			name:   "upstream removed key",
+			base:   "UMASK 022\nMAIL_DIR /var/mail\n",
+			ours:   "UMASK 077\nMAIL_DIR /var/mail\n",
+			theirs: "UMASK 022\n",
+			expect: "UMASK 077\n",
+		},
+	})
+
+	runMergeTests(t, &KeyValueMerger{Dialect: KeyValueEquals, CommentPrefixes: "#;"}, []mergeTest{
+		{
+			name:   "upstream added first key below existing comment",
+			base:   "# header\nA=1\n",
+			ours:   "# header\nA=2\n",
+			theirs: "# header\nB=3\nA=1\n",
+			expect: "# header\nB=3\nA=2\n",
+		},
+		{
+			name:   "upstream added first key above commented key",
+			base:   "# about A\nA=1\n",
+			ours:   "# about A\nA=2\n",
+			theirs: "# about B\nB=3\n# about A\nA=1\n",
+			expect: "# about B\nB=3\n# about A\nA=2\n",
+		},
+		{
+			name:   "spaces around equals",
+			base:   "; sysctl\nvm.swappiness = 60\nkernel.sysrq = 16\n",
+			ours:   "; sysctl\nvm.swappiness=10\nkernel.sysrq = 16\n",
+			theirs: "; sysctl\nvm.swappiness = 60\nkernel.sysrq = 176\nnet.core.default_qdisc = fq\n",
+			expect: "; sysctl\nvm.swappiness=10\nkernel.sysrq = 176\nnet.core.default_qdisc = fq\n",
+		},
+		{
+			name:   "same change on both sides",
+			base:   "GRUB_TIMEOUT=5\n",
+			ours:   "GRUB_TIMEOUT=0\n",
+			theirs: "GRUB_TIMEOUT = 0\n",
+			expect: "GRUB_TIMEOUT=0\n",
+		},
+	})
+}
+
+func TestIniMerger(t *testing.T) {
+	runMergeTests(t, &IniMerger{CommentPrefixes: "#;"}, []mergeTest{
+		{
+			name:   "keys in different sections",
+			base:   "[main]\ngpgcheck=1\ninstallonly_limit=3\n\n[extra]\na=1\n",
+			ours:   "[main]\ngpgcheck=1\ninstallonly_limit=5\n\n[extra]\na=1\n",
+			theirs: "[main]\ngpgcheck=True\ninstallonly_limit=3\n\n[extra]\na=2\n",
+			expect: "[main]\ngpgcheck=True\ninstallonly_limit=5\n\n[extra]\na=2\n",
+		},
+		{
+			name:   "repeated keys",
+			base:   "[Service]\nExecStart=\nExecStart=/usr/bin/a\nRestart=no\n",
+			ours:   "[Service]\nExecStart=\nExecStart=/usr/bin/a --verbose\nRestart=no\n",
+			theirs: "[Service]\nExecStart=\nExecStart=/usr/bin/a\nRestart=always\n# new option\nRestartSec=5\n",
+			expect: "[Service]\nExecStart=\nExecStart=/usr/bin/a --verbose\nRestart=always\n# new option\nRestartSec=5\n",
+		},
+		{
+			name:   "repeated keys changed upstream",
+			base:   "[Unit]\nAfter=a.service\nDescription=x\n",
+			ours:   "[Unit]\nAfter=a.service\nDescription=mine\n",
+			theirs: "[Unit]\nAfter=a.service\nAfter=b.service\nDescription=x\n",
+			expect: "[Unit]\nAfter=a.service\nAfter=b.service\nDescription=mine\n",
+		},
+		{
+			name:   "sections added and removed",
+			base:   "[Journal]\nStorage=auto\n\n[Old]\nx=1\n",
+			ours:   "[Journal]\nStorage=persistent\n\n[Old]\nx=1\n",
+			theirs: "[Journal]\nStorage=auto\n\n[New]\ny=2\n",
+			expect: "[Journal]\nStorage=persistent\n\n[New]\ny=2\n",
+		},
+		{
+			name:      "conflict",
+			base:      "[Login]\nHandleLidSwitch=suspend\n",
+			ours:      "[Login]\nHandleLidSwitch=ignore\n",
+			theirs:    "[Login]\nHandleLidSwitch=lock\n",
+			expect:    "[Login]\nHandleLidSwitch=ignore\n",
+			conflicts: 1,
+		},
+		{
+			name:   "repeated sections",
+			base:   "[Match]\nName=eth0\n\n[Route]\nGateway=10.0.0.1\n\n[Route]\nGateway=10.0.1.1\nMetric=100\n",
+			ours:   "[Match]\nName=eth0\n\n[Route]\nGateway=10.0.0.254\n\n[Route]\nGateway=10.0.1.1\nMetric=100\n",
+			theirs: "[Match]\nName=eth0\n\n[Route]\nGateway=10.0.0.1\n\n[Route]\nGateway=10.0.1.1\nMetric=200\n",
+			expect: "[Match]\nName=eth0\n\n[Route]\nGateway=10.0.0.254\n\n[Route]\nGateway=10.0.1.1\nMetric=200\n",
+		},
+	})
+}
+
+func TestFstabMerger(t *testing.T) {
+	merger, _ := GetMergeStrategy("fstab")
+
+	runMergeTests(t, merger, []mergeTest{
+		{
+			name:   "user disk and upstream tmpfs",
+			base:   "# <fs>\t<mount>\t<type>\t<options>\t<dump>\t<pass>\nUUID=a\t/\tbtrfs\tdefaults\t0\t1\n",
+			ours:   "# <fs>\t<mount>\t<type>\t<options>\t<dump>\t<pass>\nUUID=a\t/\tbtrfs\tdefaults\t0\t1\nUUID=b   /data   ext4   noatime   0 2\n",
+			theirs: "# <fs>\t<mount>\t<type>\t<options>\t<dump>\t<pass>\nUUID=a\t/\tbtrfs\tdefaults,compress=zstd\t0\t1\ntmpfs\t/tmp\ttmpfs\tdefaults\t0\t0\n",
+			expect: "# <fs>\t<mount>\t<type>\t<options>\t<dump>\t<pass>\nUUID=a\t/\tbtrfs\tdefaults,compress=zstd\t0\t1\ntmpfs\t/tmp\ttmpfs\tdefaults\t0\t0\nUUID=b   /data   ext4   noatime   0 2\n",
+		},
+		{
+			name:   "multiple swaps",
+			base:   "/dev/sda2 none swap sw 0 0\n",
+			ours:   "/dev/sda2 none swap sw 0 0\n/swapfile none swap sw 0 0\n",
+			theirs: "/dev/sda2 none swap sw 0 0\n",
+			expect: "/dev/sda2 none swap sw 0 0\n/swapfile none swap sw 0 0\n",
+		},
+		{
+			name:      "duplicate mount point",
+			base:      "",
+			ours:      "UUID=a /data ext4 defaults 0 2\nUUID=b /data ext4 defaults 0 2\n",
+			theirs:    "",
+			expect:    "UUID=a /data ext4 defaults 0 2\nUUID=b /data ext4 defaults 0 2\n",
+			conflicts: 1,
+		},
+		{
+			name:      "both changed",
+			base:      "UUID=a /home ext4 defaults 0 2\n",
+			ours:      "UUID=a /home ext4 noatime 0 2\n",
+			theirs:    "UUID=a /home ext4 defaults,nodev 0 2\n",
+			expect:    "UUID=a /home ext4 noatime 0 2\n",
+			conflicts: 1,
+		},
+	})
+
+	merger, _ = GetMergeStrategy("crypttab")
+
+	runMergeTests(t, merger, []mergeTest{
+		{
+			name:   "keyed by name",
+			base:   "luks-root UUID=x none luks\n",
+			ours:   "luks-root UUID=x none luks,discard\nluks-data UUID=y /etc/keyfile luks\n",
+			theirs: "luks-root UUID=x none luks\nswap /dev/sdb1 /dev/urandom swap\n",
+			expect: "luks-root UUID=x none luks,discard\nswap /dev/sdb1 /dev/urandom swap\nluks-data UUID=y /etc/keyfile luks\n",
+		},
+	})
+}
+
+func TestHostsMerger(t *testing.T) {
+	runMergeTests(t, &HostsMerger{}, []mergeTest{
+		{
+			name:   "upstream ipv6 lines and user host",
+			base:   "127.0.0.1\tlocalhost\n::1\tlocalhost\n",
+			ours:   "127.0.0.1\tlocalhost\n::1\tlocalhost\n\n# my machines\n192.168.1.2 server\n",
+			theirs: "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\nff02::1\tip6-allnodes\n",
+			expect: "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\nff02::1\tip6-allnodes\n\n# my machines\n192.168.1.2 server\n",
+		},
+		{
+			name:   "upstream alias for user's address",
+			base:   "127.0.0.1 localhost\n",
+			ours:   "127.0.0.1 localhost myhost # mine\n192.168.1.2 server\n",
+			theirs: "127.0.0.1 localhost localhost.localdomain\n10.0.0.1 gateway\n",
+			expect: "127.0.0.1 localhost myhost localhost.localdomain # mine\n10.0.0.1 gateway\n192.168.1.2 server\n",
+		},
+		{
+			name:   "upstream removed a name",
+			base:   "127.0.0.1 localhost oldname\n",
+			ours:   "127.0.0.1 localhost oldname myhost # mine\n",
+			theirs: "127.0.0.1 localhost\n",
+			expect: "127.0.0.1 localhost myhost # mine\n",
+		},
+		{
+			name:      "conflicting mapping",
+			base:      "127.0.0.1 localhost\n",
+			ours:      "127.0.0.1 localhost\n192.168.1.2 server\n",
+			theirs:    "127.0.0.1 localhost\n10.0.0.2 server\n::1 server\n",
+			expect:    "127.0.0.1 localhost\n::1 server\n192.168.1.2 server\n",
+			conflicts: 1,
+		},
+	})
+}
+
+func TestPamMerger(t *testing.T) {
+	base := "#%PAM-1.0\nauth\trequired\tpam_env.so\nauth\tsufficient\tpam_unix.so try_first_pass nullok\nauth\trequired\tpam_deny.so\n\naccount\trequired\tpam_unix.so\n\nsession\toptional\tpam_keyinit.so revoke\nsession\trequired\tpam_unix.so\n"
+
+	runMergeTests(t, &PamMerger{}, []mergeTest{
+		{
+			name:   "upstream adds module",
+			base:   base,
+			ours:   strings.Replace(base, "auth\trequired\tpam_deny.so\n", "auth\tsufficient\tpam_fprintd.so\nauth\trequired\tpam_deny.so\n", 1),
+			theirs: strings.Replace(base, "session\trequired\tpam_unix.so\n", "session\trequired\tpam_unix.so\n-session\toptional\tpam_systemd.so\n", 1),
+			expect: strings.Replace(strings.Replace(base, "auth\trequired\tpam_deny.so\n", "auth\tsufficient\tpam_fprintd.so\nauth\trequired\tpam_deny.so\n", 1), "session\trequired\tpam_unix.so\n", "session\trequired\tpam_unix.so\n-session\toptional\tpam_systemd.so\n", 1),
+		},
+		{
+			name:   "upstream changes arguments",
+			base:   base,
+			ours:   base,
+			theirs: strings.Replace(base, "pam_keyinit.so revoke", "pam_keyinit.so force revoke", 1),
+			expect: strings.Replace(base, "pam_keyinit.so revoke", "pam_keyinit.so force revoke", 1),
+		},
+		{
+			name:      "upstream changes auth arguments",
+			base:      base,
+			ours:      base,
+			theirs:    strings.Replace(base, "try_first_pass nullok", "try_first_pass", 1),
+			expect:    base,
+			conflicts: 1,
+		},
+		{
+			name:      "upstream makes auth line optional",
+			base:      "auth required pam_faillock.so preauth deny=3\nauth sufficient pam_unix.so\n",
+			ours:      "auth required pam_faillock.so preauth deny=3\nauth sufficient pam_unix.so\nauth sufficient pam_fprintd.so\n",
+			theirs:    "auth optional pam_faillock.so preauth deny=3\nauth sufficient pam_unix.so\n",
+			expect:    "auth required pam_faillock.so preauth deny=3\nauth sufficient pam_unix.so\nauth sufficient pam_fprintd.so\n",
+			conflicts: 1,
+		},
+		{
+			name:      "both change the same line",
+			base:      base,
+			ours:      strings.Replace(base, "session\toptional\tpam_keyinit.so revoke", "session\trequired\tpam_keyinit.so revoke", 1),
+			theirs:    strings.Replace(base, "session\toptional\tpam_keyinit.so revoke", "session\toptional\tpam_keyinit.so force revoke", 1),
+			expect:    strings.Replace(base, "session\toptional\tpam_keyinit.so revoke", "session\trequired\tpam_keyinit.so revoke", 1),
+			conflicts: 1,
+		},
+		{
+			name:      "upstream removes auth line",
+			base:      base,
+			ours:      base + "session\toptional\tpam_umask.so\n",
+			theirs:    strings.Replace(base, "auth\trequired\tpam_deny.so\n", "", 1),
+			expect:    base + "session\toptional\tpam_umask.so\n",
+			conflicts: 1,
+		},
+		{
+			name:      "upstream reorders account lines",
+			base:      "account [default=bad success=ok user_unknown=ignore] pam_sss.so\naccount required pam_unix.so\n",
+			ours:      "account [default=bad success=ok user_unknown=ignore] pam_sss.so\naccount required pam_unix.so\n",
+			theirs:    "account required pam_unix.so\naccount [default=bad success=ok user_unknown=ignore] pam_sss.so\n",
+			expect:    "account [default=bad success=ok user_unknown=ignore] pam_sss.so\naccount required pam_unix.so\n",
+			conflicts: 1,
+		},
+		{
+			name:   "upstream removes session line",
+			base:   base,
+			ours:   base,
+			theirs: strings.Replace(base, "session\toptional\tpam_keyinit.so revoke\n", "", 1),
+			expect: strings.Replace(base, "session\toptional\tpam_keyinit.so revoke\n", "", 1),
+		},
+		{
+			name:   "repeated modules",
+			base:   "session requisite pam_succeed_if.so uid >= 1000\nsession requisite pam_succeed_if.so user ingroup wheel\n",
+			ours:   "session requisite pam_succeed_if.so uid >= 1000\nsession requisite pam_succeed_if.so user ingroup admin\n",
+			theirs: "session requisite pam_succeed_if.so uid >= 500\nsession requisite pam_succeed_if.so user ingroup wheel\n",
+			expect: "session requisite pam_succeed_if.so uid >= 500\nsession requisite pam_succeed_if.so user ingroup admin\n",
+		},
+	})
+}
+
+func TestNsswitchMerger(t *testing.T) {
+	base := "# Generated\npasswd:     files systemd\ngroup:      files systemd\nhosts:      files dns\n"
+
+	runMergeTests(t, &NsswitchMerger{}, []mergeTest{
+		{
+			name:   "only upstream changed",
+			base:   base,
+			ours:   base,
+			theirs: strings.Replace(base, "files dns", "files myhostname dns", 1),
+			expect: strings.Replace(base, "files dns", "files myhostname dns", 1),
+		},
+		{
+			name:   "both add sources",
+			base:   base,
+			ours:   strings.Replace(base, "passwd:     files systemd", "passwd:     sss files systemd", 1),
+			theirs: strings.Replace(base, "passwd:     files systemd", "passwd:     files systemd mymachines", 1),
+			expect: strings.Replace(base, "passwd:     files systemd", "passwd:     sss files systemd mymachines", 1),
+		},
+		{
+			name:   "action tokens stay with their source",
+			base:   "hosts: files dns\n",
+			ours:   "hosts: files mdns4_minimal [NOTFOUND=return] dns\n",
+			theirs: "hosts: files resolve [!UNAVAIL=return] dns\n",
+			expect: "hosts: files resolve [!UNAVAIL=return] mdns4_minimal [NOTFOUND=return] dns\n",
+		},
+		{
+			name:   "upstream removes source",
+			base:   "group: files systemd\n",
+			ours:   "group: files systemd sss\n",
+			theirs: "group: files\n",
+			expect: "group: files sss\n",
+		},
+		{
+			name:      "actions changed differently",
+			base:      "hosts: files dns\n",
+			ours:      "hosts: files [SUCCESS=return] dns ldap\n",
+			theirs:    "hosts: files [NOTFOUND=continue] dns myhostname\n",
+			expect:    "hosts: files [SUCCESS=return] dns myhostname ldap\n",
+			conflicts: 1,
+		},
+		{
+			name:   "upstream adds database",
+			base:   base,
+			ours:   base,
+			theirs: base + "shadow:     files\n",
+			expect: base + "shadow:     files\n",
+		},
+		{
+			name:      "user removed changed database",
+			base:      base,
+			ours:      strings.Replace(base, "hosts:      files dns\n", "", 1),
+			theirs:    strings.Replace(base, "files dns", "files myhostname dns", 1),
+			expect:    strings.Replace(base, "hosts:      files dns\n", "", 1),
+			conflicts: 1,
+		},
+	})
+}
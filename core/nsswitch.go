@@ -0,0 +1,156 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NsswitchMerger merges /etc/nsswitch.conf, which maps databases to a list of sources.
+//
+// Databases are merged like the keys of a KeyValueMerger. If the user and the update
+// both changed the sources of a database, the source lists are merged the same way:
+// the user's order is kept, sources the update added are inserted after the source
+// preceding them in the update and action tokens like [NOTFOUND=return] stay with the
+// source they follow. Sources whose actions were changed differently are conflicts.
+type NsswitchMerger struct{}
+
+// nsswitchLine is a parsed line of nsswitch.conf, the prefix contains
+// the database, the colon and the whitespace after it
+type nsswitchLine struct {
+	keyValueLine
+	prefix  string
+	sources []keyValueLine
+}
+
+func (m *NsswitchMerger) parse(contents []byte) []nsswitchLine {
+	lines := []nsswitchLine{}
+
+	if len(contents) == 0 {
+		return lines
+	}
+
+	for raw := range strings.SplitSeq(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		trimmed := strings.TrimSpace(raw)
+		line := nsswitchLine{keyValueLine: keyValueLine{raw: raw}}
+
+		database, sources, ok := strings.Cut(trimmed, ":")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || !ok {
+			lines = append(lines, line)
+			continue
+		}
+
+		line.key = strings.TrimSpace(database)
+		colon := strings.Index(raw, ":") + 1
+		rest := raw[colon:]
+		line.prefix = raw[:colon] + rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+		line.sources = parseNsswitchSources(sources)
+		line.value = joinNsswitchSources(line.sources)
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// parseNsswitchSources splits a source list into sources together with the
+// action tokens following them, actions may contain spaces inside the brackets
+func parseNsswitchSources(list string) []keyValueLine {
+	sources := []keyValueLine{}
+	actions := false
+
+	for _, field := range strings.Fields(list) {
+		switch {
+		case actions:
+			last := &sources[len(sources)-1]
+			last.value += " " + field
+			actions = !strings.HasSuffix(field, "]")
+		case strings.HasPrefix(field, "["):
+			if len(sources) == 0 {
+				// actions without a source are kept in place
+				sources = append(sources, keyValueLine{})
+			}
+			last := &sources[len(sources)-1]
+			last.value = strings.TrimSpace(last.value + " " + field)
+			actions = !strings.HasSuffix(field, "]")
+		default:
+			sources = append(sources, keyValueLine{key: field})
+		}
+	}
+
+	for i := range sources {
+		sources[i].raw = strings.TrimSpace(sources[i].key + " " + sources[i].value)
+	}
+
+	return sources
+}
+
+func joinNsswitchSources(sources []keyValueLine) string {
+	raw := make([]string, len(sources))
+	for i, source := range sources {
+		raw[i] = source.raw
+	}
+
+	return strings.Join(raw, " ")
+}
+
+func nsswitchDatabases(lines []nsswitchLine) map[string]nsswitchLine {
+	databases := make(map[string]nsswitchLine)
+
+	for _, line := range lines {
+		if line.key != "" {
+			databases[line.key] = line
+		}
+	}
+
+	return databases
+}
+
+func keyedNsswitchLines(lines []nsswitchLine) []keyValueLine {
+	keyed := make([]keyValueLine, len(lines))
+	for i, line := range lines {
+		keyed[i] = line.keyValueLine
+	}
+
+	return keyed
+}
+
+func (m *NsswitchMerger) Merge(base, ours, theirs []byte) ([]byte, []Conflict, error) {
+	baseLines := m.parse(base)
+	oursLines := m.parse(ours)
+	theirsLines := m.parse(theirs)
+
+	baseDatabases := nsswitchDatabases(baseLines)
+	theirsDatabases := nsswitchDatabases(theirsLines)
+
+	conflicts := []Conflict{}
+
+	// databases both sides changed are merged source by source, using the result for
+	// both sides afterwards makes mergeKeyedLines treat them as identical changes
+	for i, line := range oursLines {
+		baseLine, inBase := baseDatabases[line.key]
+		theirsLine, inTheirs := theirsDatabases[line.key]
+		if line.key == "" || !inBase || !inTheirs || line.value == baseLine.value || theirsLine.value == baseLine.value {
+			continue
+		}
+
+		sources, sourceConflicts := mergeKeyedLines(baseLine.sources, line.sources, theirsLine.sources, "source")
+		for _, conflict := range sourceConflicts {
+			conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("database %s: %s", line.key, conflict.Reason)})
+		}
+
+		line.sources = sources
+		line.value = joinNsswitchSources(sources)
+		line.raw = line.prefix + line.value
+		oursLines[i] = line
+
+		for j := range theirsLines {
+			if theirsLines[j].key == line.key {
+				theirsLines[j] = line
+			}
+		}
+	}
+
+	merged, databaseConflicts := mergeKeyedLines(keyedNsswitchLines(baseLines), keyedNsswitchLines(oursLines), keyedNsswitchLines(theirsLines), "database")
+	conflicts = append(conflicts, databaseConflicts...)
+
+	return joinKeyedLines(merged), conflicts, nil
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// PamMerger merges PAM stacks like the ones in /etc/pam.d.
+//
+// Lines are identified by their type and module and merged like the keys of a
+// KeyValueMerger, so the user's order is kept and modules the update added are
+// inserted after the line preceding them in the update. A line counts as changed
+// if its control flag or arguments changed.
+//
+// Removing, reordering or changing auth and account lines can silently weaken
+// authentication, so if the update does any of these, nothing is merged and a
+// conflict is reported instead.
+type PamMerger struct{}
+
+// guardedPamTypes are the stacks in which the update may not remove, reorder or change lines
+var guardedPamTypes = []string{"auth", "account", "@include"}
+
+// splitPamLine splits a non-empty PAM line into its type, control, module and
+// arguments. Controls can be written as [value=action ...] which may contain spaces.
+func splitPamLine(line string) (pamType, control, module, args string) {
+	line = strings.TrimSpace(line)
+	pamType = strings.Fields(line)[0]
+	rest := strings.TrimSpace(line[len(pamType):])
+
+	if pamType == "@include" {
+		return pamType, "", rest, ""
+	}
+
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			end = len(rest) - 1
+		}
+		control, rest = rest[:end+1], strings.TrimSpace(rest[end+1:])
+	} else {
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return pamType, "", "", ""
+		}
+		control = fields[0]
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, control))
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return pamType, control, "", ""
+	}
+
+	return pamType, strings.Join(strings.Fields(control), " "), fields[0], strings.Join(fields[1:], " ")
+}
+
+func (m *PamMerger) parse(contents []byte) []keyValueLine {
+	lines := []keyValueLine{}
+	occurrences := make(map[string]int)
+
+	if len(contents) == 0 {
+		return lines
+	}
+
+	for raw := range strings.SplitSeq(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		trimmed := strings.TrimSpace(raw)
+		line := keyValueLine{raw: raw}
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			lines = append(lines, line)
+			continue
+		}
+
+		pamType, control, module, args := splitPamLine(trimmed)
+
+		// a leading - only silences errors about missing modules, it's still the same line
+		key := strings.TrimPrefix(pamType, "-") + " " + path.Base(module)
+		occurrences[key]++
+		if occurrences[key] > 1 {
+			// modules like pam_succeed_if are often used more than once in a stack
+			key = fmt.Sprintf("%s #%d", key, occurrences[key])
+		}
+
+		line.key = key
+		line.value = strings.Join([]string{pamType, control, module, args}, " ")
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// pamStack returns the keys of all lines of the given type in order
+func pamStack(lines []keyValueLine, pamType string) []string {
+	stack := []string{}
+
+	for _, line := range lines {
+		if strings.HasPrefix(line.key, pamType+" ") {
+			stack = append(stack, line.key)
+		}
+	}
+
+	return stack
+}
+
+// weakenedPamStacks finds the lines of guarded stacks the update removed, reordered or changed
+func weakenedPamStacks(baseLines, theirsLines []keyValueLine) []Conflict {
+	conflicts := []Conflict{}
+	baseValues := keyValues(baseLines)
+	theirsValues := keyValues(theirsLines)
+
+	for _, pamType := range guardedPamTypes {
+		baseStack := pamStack(baseLines, pamType)
+		theirsStack := pamStack(theirsLines, pamType)
+
+		kept := []string{}
+		for _, key := range baseStack {
+			if slices.Contains(theirsStack, key) {
+				kept = append(kept, key)
+				// a changed control flag or argument can make a module optional or less strict
+				if baseValues[key].value != theirsValues[key].value {
+					conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("the update changes %s in the PAM stack", key)})
+				}
+			} else {
+				conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("the update removes %s from the PAM stack", key)})
+			}
+		}
+
+		theirsOrder := slices.DeleteFunc(slices.Clone(theirsStack), func(key string) bool {
+			return !slices.Contains(kept, key)
+		})
+		if !slices.Equal(kept, theirsOrder) {
+			conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("the update reorders the %s lines of the PAM stack", pamType)})
+		}
+	}
+
+	return conflicts
+}
+
+func (m *PamMerger) Merge(base, ours, theirs []byte) ([]byte, []Conflict, error) {
+	baseLines := m.parse(base)
+	theirsLines := m.parse(theirs)
+
+	weakened := weakenedPamStacks(baseLines, theirsLines)
+	if len(weakened) != 0 {
+		for i := range weakened {
+			weakened[i].Reason += ", keeping the user's version for review"
+		}
+		return ours, weakened, nil
+	}
+
+	merged, conflicts := mergeKeyedLines(baseLines, m.parse(ours), theirsLines, "PAM line")
+	return joinKeyedLines(merged), conflicts, nil
+}
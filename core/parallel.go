@@ -0,0 +1,105 @@
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// normalizeConcurrency turns a configured concurrency limit into a usable
+// number of workers, values below 1 use one worker per CPU
+func normalizeConcurrency(concurrency int) int {
+	if concurrency < 1 {
+		return runtime.NumCPU()
+	}
+
+	return concurrency
+}
+
+// forEachParallel calls fn for every index from 0 to count-1 using at most
+// concurrency workers at the same time.
+//
+// The returned errors are stored at the index they belong to, so callers
+// can report them in a stable order regardless of scheduling.
+func forEachParallel(count, concurrency int, fn func(i int) error) []error {
+	errs := make([]error, count)
+	workers := min(normalizeConcurrency(concurrency), count)
+
+	indices := make(chan int)
+	waitGroup := sync.WaitGroup{}
+
+	for range workers {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for i := range indices {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+
+	for i := range count {
+		indices <- i
+	}
+	close(indices)
+
+	waitGroup.Wait()
+
+	return errs
+}
+
+// firstError returns the error with the lowest index
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type walkEntry struct {
+	path  string
+	entry fs.DirEntry
+	// info is taken before a folder is read, so its access time is still the original one
+	info os.FileInfo
+}
+
+// walkTree lists all paths in root in lexical order, parents before their children
+func walkTree(root string) ([]walkEntry, error) {
+	return walkTreeWith(root, func(path string, err error) error {
+		return err
+	})
+}
+
+// walkTreeWith lists all paths in root, problems with a path are passed to onError.
+// If onError returns nil the path and, for folders, its contents are left out and
+// the walk goes on, otherwise the walk stops with that error.
+func walkTreeWith(root string, onError func(path string, err error) error) ([]walkEntry, error) {
+	entries := []walkEntry{}
+
+	err := fs.WalkDir(os.DirFS(root), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			err = onError(path, fmt.Errorf("can't search path \"%s\": %w", path, err))
+			if err == nil && d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return err
+		}
+
+		info, err := os.Lstat(filepath.Join(root, path))
+		if err != nil {
+			return onError(path, fmt.Errorf("can't find information about \"%s\": %w", path, err))
+		}
+
+		entries = append(entries, walkEntry{path: path, entry: d, info: info})
+
+		return nil
+	})
+
+	return entries, err
+}
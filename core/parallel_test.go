@@ -0,0 +1,50 @@
+package core
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForEachParallel(t *testing.T) {
+	const count = 100
+	const concurrency = 3
+
+	running := atomic.Int32{}
+	maxRunning := atomic.Int32{}
+
+	errs := forEachParallel(count, concurrency, func(i int) error {
+		now := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			highest := maxRunning.Load()
+			if now <= highest || maxRunning.CompareAndSwap(highest, now) {
+				break
+			}
+		}
+
+		if i%10 == 0 {
+			return errors.New(strconv.Itoa(i))
+		}
+		return nil
+	})
+
+	if maxRunning.Load() > concurrency {
+		t.Errorf("%d workers ran at the same time, limit was %d", maxRunning.Load(), concurrency)
+	}
+
+	for i, err := range errs {
+		if (i%10 == 0) != (err != nil) {
+			t.Fatalf("error of index %d is %v", i, err)
+		}
+		if err != nil && err.Error() != strconv.Itoa(i) {
+			t.Fatalf("error %v is stored at index %d", err, i)
+		}
+	}
+
+	if firstError(errs).Error() != "0" {
+		t.Error("first error is not the one with the lowest index")
+	}
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// PolicyAction decides how a path is treated while building a new etc
+type PolicyAction int
+
+const (
+	// PolicyDefault uses the built-in behavior: unmodified copies follow the update,
+	// changes of both sides are merged with the strategy from MergeRules
+	PolicyDefault PolicyAction = iota
+	// PolicyKeepUser always keeps the user's version without merging or reporting conflicts
+	PolicyKeepUser
+	// PolicyTakeUpstream drops the user's version of paths the system knows about
+	PolicyTakeUpstream
+	// PolicyMerge merges changes of both sides with the strategy of the rule
+	PolicyMerge
+	// PolicyIgnore leaves the path out of the new upper and all reports
+	PolicyIgnore
+	// PolicyConflictOnChange keeps the user's version and reports a conflict
+	// whenever the update changes the path
+	PolicyConflictOnChange
+)
+
+func (a PolicyAction) String() string {
+	switch a {
+	case PolicyDefault:
+		return "default"
+	case PolicyKeepUser:
+		return "keep-user"
+	case PolicyTakeUpstream:
+		return "take-upstream"
+	case PolicyMerge:
+		return "merge"
+	case PolicyIgnore:
+		return "ignore"
+	case PolicyConflictOnChange:
+		return "conflict-on-change"
+	default:
+		return fmt.Sprintf("PolicyAction(%d)", int(a))
+	}
+}
+
+// PolicyRule applies an action to all paths matching Pattern
+type PolicyRule struct {
+	// Pattern is matched against paths relative to the etc folders with path.Match
+	Pattern string
+	Action  PolicyAction
+	// Strategy is the merge strategy used by PolicyMerge
+	Strategy string
+}
+
+// Policy decides per path how the build treats it.
+//
+// The rule for a path is the most specific rule whose pattern matches it: patterns
+// without wildcards win over patterns with wildcards, otherwise the pattern with the
+// most characters that aren't part of a wildcard wins. If rules are equally specific,
+// the first one wins. Paths no rule matches use the rule of their folder.
+type Policy struct {
+	Rules []PolicyRule
+}
+
+// PolicySyntaxError is a problem with a line of a policy file
+type PolicySyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *PolicySyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// LoadPolicy reads a policy file, see ParsePolicy for its format
+func LoadPolicy(file string) (*Policy, error) {
+	policyFile, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't open policy file: %w", err)
+	}
+	defer policyFile.Close()
+
+	policy, err := ParsePolicy(policyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse policy file %s: %w", file, err)
+	}
+
+	return policy, nil
+}
+
+// ParsePolicy parses a policy with one rule per line, consisting of a pattern and
+// an action separated by whitespace. Actions are keep-user, take-upstream,
+// merge:<strategy>, ignore and conflict-on-change. Empty lines and lines
+// starting with # are ignored.
+func ParsePolicy(reader io.Reader) (*Policy, error) {
+	policy := &Policy{Rules: []PolicyRule{}}
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, &PolicySyntaxError{Line: lineNumber, Msg: "expected a pattern and an action"}
+		}
+
+		rule, err := parsePolicyRule(fields[0], fields[1])
+		if err != nil {
+			return nil, &PolicySyntaxError{Line: lineNumber, Msg: err.Error()}
+		}
+
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("can't read policy: %w", err)
+	}
+
+	return policy, nil
+}
+
+func parsePolicyRule(pattern, action string) (PolicyRule, error) {
+	rule := PolicyRule{Pattern: strings.Trim(pattern, "/")}
+
+	_, err := path.Match(rule.Pattern, "")
+	if err != nil {
+		return rule, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+
+	switch action {
+	case "keep-user":
+		rule.Action = PolicyKeepUser
+	case "take-upstream":
+		rule.Action = PolicyTakeUpstream
+	case "ignore":
+		rule.Action = PolicyIgnore
+	case "conflict-on-change":
+		rule.Action = PolicyConflictOnChange
+	default:
+		strategy, ok := strings.CutPrefix(action, "merge:")
+		if !ok {
+			return rule, fmt.Errorf("unknown action %s", action)
+		}
+
+		_, ok = GetMergeStrategy(strategy)
+		if !ok {
+			return rule, fmt.Errorf("%w: %s", ErrUnknownMergeStrategy, strategy)
+		}
+
+		rule.Action = PolicyMerge
+		rule.Strategy = strategy
+	}
+
+	return rule, nil
+}
+
+// RuleFor returns the rule used for path, paths without a rule get
+// a rule with PolicyDefault. A nil policy has no rules.
+func (p *Policy) RuleFor(filePath string) PolicyRule {
+	if p == nil {
+		return PolicyRule{}
+	}
+
+	for current := filePath; current != "." && current != "/"; current = path.Dir(current) {
+		rule, ok := p.matchingRule(current)
+		if ok {
+			return rule
+		}
+	}
+
+	return PolicyRule{}
+}
+
+// matchingRule finds the most specific rule matching filePath itself
+func (p *Policy) matchingRule(filePath string) (PolicyRule, bool) {
+	best := -1
+	bestExact := false
+	bestLiterals := 0
+
+	for i, rule := range p.Rules {
+		if matched, _ := path.Match(rule.Pattern, filePath); !matched {
+			continue
+		}
+
+		exact, literals := patternSpecificity(rule.Pattern)
+		if best >= 0 && (bestExact && !exact || bestExact == exact && bestLiterals >= literals) {
+			continue
+		}
+
+		best = i
+		bestExact = exact
+		bestLiterals = literals
+	}
+
+	if best < 0 {
+		return PolicyRule{}, false
+	}
+
+	return p.Rules[best], true
+}
+
+// patternSpecificity returns if pattern contains no wildcards
+// and how many characters it contains outside of wildcards
+func patternSpecificity(pattern string) (bool, int) {
+	literals := 0
+	inClass := false
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case inClass:
+			inClass = pattern[i] != ']'
+		case pattern[i] == '\\':
+			i++
+			literals++
+		case pattern[i] == '[':
+			inClass = true
+		case pattern[i] != '*' && pattern[i] != '?':
+			literals++
+		}
+	}
+
+	return !strings.ContainsAny(pattern, "*?["), literals
+}
+
+// keepsUser checks if the rule keeps the user's version regardless of the update
+func (r PolicyRule) keepsUser() bool {
+	return r.Action == PolicyKeepUser || r.Action == PolicyConflictOnChange
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `# comments and empty lines are ignored
+
+ssh/*                keep-user
+ssh/ssh_config       take-upstream
+ssh/ssh*_config      conflict-on-change
+*.conf               merge:kv
+resolv.conf          ignore
+default/*            merge:kv
+default/[gk]rub      keep-user
+default/?rub         take-upstream
+skel                 keep-user
+`
+
+func TestPolicyRuleFor(t *testing.T) {
+	policy, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		expect PolicyAction
+	}{
+		// patterns without wildcards win over all others
+		{"ssh/ssh_config", PolicyTakeUpstream},
+		// otherwise the pattern with more literal characters wins
+		{"ssh/sshd_config", PolicyConflictOnChange},
+		{"ssh/moduli", PolicyKeepUser},
+		{"resolv.conf", PolicyIgnore},
+		{"dnf.conf", PolicyMerge},
+		// wildcards and character classes don't count as literal characters,
+		// so equally specific rules are decided by their order
+		{"default/grub", PolicyKeepUser},
+		{"default/useradd", PolicyMerge},
+		// contents of folders use the rule of the folder
+		{"skel/.bashrc", PolicyKeepUser},
+		{"skel/.config/autostart/a.desktop", PolicyKeepUser},
+		// but patterns don't match across folders
+		{"ssh/sshd_config.d/50-cloud.conf", PolicyKeepUser},
+		{"motd", PolicyDefault},
+	}
+
+	for _, test := range tests {
+		rule := policy.RuleFor(test.path)
+		if rule.Action != test.expect {
+			t.Errorf("%s uses %s (%s) instead of %s", test.path, rule.Action, rule.Pattern, test.expect)
+		}
+	}
+
+	rule := policy.RuleFor("dnf.conf")
+	if rule.Strategy != "kv" {
+		t.Errorf("merge rule uses strategy %s", rule.Strategy)
+	}
+
+	var noPolicy *Policy
+	if noPolicy.RuleFor("passwd").Action != PolicyDefault {
+		t.Error("nil policy has rules")
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	tests := map[string]int{
+		"passwd keep-user\nshadow\n":         2,
+		"passwd keep-user extra\n":           1,
+		"passwd overwrite\n":                 1,
+		"[passwd keep-user\n":                1,
+		"\n\nhosts merge:no-such-strategy\n": 3,
+	}
+
+	for contents, line := range tests {
+		_, err := ParsePolicy(strings.NewReader(contents))
+
+		var syntaxErr *PolicySyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("policy %q was accepted", contents)
+			continue
+		}
+		if syntaxErr.Line != line {
+			t.Errorf("policy %q has an error in line %d instead of %d", contents, syntaxErr.Line, line)
+		}
+	}
+}
+
+func TestBuildWithPolicy(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	files := map[string]string{
+		// unmodified copy pinned by the user
+		filepath.Join(oldSys, "pinned"):  "old\n",
+		filepath.Join(newSys, "pinned"):  "new\n",
+		filepath.Join(oldUser, "pinned"): "old\n",
+		// modified by the user, but the system version is wanted
+		filepath.Join(oldSys, "managed"):  "old\n",
+		filepath.Join(newSys, "managed"):  "old\n",
+		filepath.Join(oldUser, "managed"): "mine\n",
+		// never carried over
+		filepath.Join(oldUser, "cache/data"): "x\n",
+		// merged with a strategy no merge rule configures
+		filepath.Join(oldSys, "app.cfg"):  "a=1\nb=1\n",
+		filepath.Join(newSys, "app.cfg"):  "a=1\nb=2\n",
+		filepath.Join(oldUser, "app.cfg"): "a=5\nb=1\n",
+		// reviewed on every change, even if unmodified
+		filepath.Join(oldSys, "reviewed"):  "old\n",
+		filepath.Join(newSys, "reviewed"):  "new\n",
+		filepath.Join(oldUser, "reviewed"): "old\n",
+	}
+	writeFiles(t, files)
+
+	policy, err := ParsePolicy(strings.NewReader("pinned keep-user\nmanaged take-upstream\ncache ignore\napp.cfg merge:kv\nreviewed conflict-on-change\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := DefaultBuildOptions()
+	options.Policy = policy
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"pinned":   "old\n",
+		"app.cfg":  "a=5\nb=2\n",
+		"reviewed": "old\n",
+	}
+	for path, contents := range expected {
+		actual, err := os.ReadFile(filepath.Join(newUser, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != contents {
+			t.Errorf("%s contains\n%s\ninstead of\n%s", path, actual, contents)
+		}
+	}
+
+	for _, path := range []string{"managed", "cache"} {
+		_, err = os.Lstat(filepath.Join(newUser, path))
+		if err == nil {
+			t.Errorf("%s was carried into the new upper", path)
+		}
+	}
+
+	if !slices.Equal(report.Merged, []string{"app.cfg"}) {
+		t.Errorf("merged %v", report.Merged)
+	}
+	if len(report.Conflicts) != 1 || report.Conflicts[0].Path != "reviewed" {
+		t.Errorf("conflicts are %v", report.Conflicts)
+	}
+	if len(report.StaleShadows) != 0 {
+		t.Errorf("stale shadows are %v", report.StaleShadows)
+	}
+	if !slices.Equal(report.KeptStaleShadows, []string{"pinned", "reviewed"}) {
+		t.Errorf("kept stale shadows are %v", report.KeptStaleShadows)
+	}
+}
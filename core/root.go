@@ -0,0 +1,74 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const maxSymlinkHops = 40
+
+// resolveInRoot resolves path the way the kernel would if root was the root
+// folder, so symlinks inside root can't point outside of it.
+//
+// returns the resolved path including root
+func resolveInRoot(root, path string) (string, error) {
+	return resolveWith(func(path string) string { return filepath.Join(root, path) }, path)
+}
+
+// resolveWith resolves path like resolveInRoot, but uses locate to find
+// where an absolute path of the resolved system is stored
+func resolveWith(locate func(path string) string, path string) (string, error) {
+	remaining := strings.Split(path, "/")
+	current := "/"
+	hops := 0
+
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, part)
+
+		info, err := os.Lstat(locate(next))
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", &os.PathError{Op: "resolve", Path: path, Err: syscall.ELOOP}
+		}
+
+		target, err := os.Readlink(locate(next))
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	return locate(current), nil
+}
+
+// existsInRoot checks if path exists when root is used as the root folder
+func existsInRoot(root, path string) bool {
+	_, err := resolveInRoot(root, path)
+	return err == nil
+}
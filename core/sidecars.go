@@ -0,0 +1,173 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// SidecarSuffixes are the suffixes package managers use for the new version of
+// a configuration file they didn't overwrite because the user had changed it
+var SidecarSuffixes = []string{".rpmnew", ".dpkg-dist", ".dpkg-new", ".pacnew"}
+
+// SidecarAction is what happened to a sidecar while building a new etc
+type SidecarAction int
+
+const (
+	// SidecarKept means the sidecar was carried into the new upper
+	SidecarKept SidecarAction = iota
+	// SidecarDropped means the sidecar was removed since the new lower contains
+	// the same version of the configuration file or the user has no own version
+	SidecarDropped
+	// SidecarMerged means the changes of the update since the sidecar were
+	// merged into the user's configuration file and the sidecar was removed
+	SidecarMerged
+)
+
+func (a SidecarAction) String() string {
+	switch a {
+	case SidecarKept:
+		return "kept"
+	case SidecarDropped:
+		return "dropped"
+	case SidecarMerged:
+		return "merged"
+	default:
+		return fmt.Sprintf("SidecarAction(%d)", int(a))
+	}
+}
+
+// Sidecar is a sidecar found in the upper
+type Sidecar struct {
+	// Path is the path of the sidecar relative to the etc folders
+	Path string
+	// Config is the path of the configuration file the sidecar belongs to
+	Config string
+	Action SidecarAction
+	// Reason explains why a sidecar was kept
+	Reason string
+}
+
+func (s Sidecar) String() string {
+	if s.Reason != "" {
+		return fmt.Sprintf("%s: %s, %s", s.Path, s.Action, s.Reason)
+	}
+
+	return fmt.Sprintf("%s: %s", s.Path, s.Action)
+}
+
+// sidecarConfig returns the configuration file a sidecar belongs to
+func sidecarConfig(path string) (string, bool) {
+	for _, suffix := range SidecarSuffixes {
+		config, ok := strings.CutSuffix(path, suffix)
+		if ok && config != "" && !strings.HasSuffix(config, "/") {
+			return config, true
+		}
+	}
+
+	return "", false
+}
+
+// resolveSidecars finds the sidecars of the upper that are carried into the new upper.
+//
+// If resolve is set, sidecars identical to the new lower version of their configuration file or
+// without a user version of it are marked as dropped. Otherwise the sidecar is the version the user's
+// file should have been based on, so it's returned as the base mergeChangedFiles merges the update
+// into the user's file with, and finishMergedSidecars marks it as merged if that had no conflicts.
+//
+// Nothing is removed, applyBuildPlan removes the sidecars that aren't kept.
+func resolveSidecars(changes ChangeSet, dropped, handled map[string]bool, rules *buildRules, resolve bool, lowerNew, upper string) ([]Sidecar, map[string]string, error) {
+	sidecars := []Sidecar{}
+	bases := make(map[string]string)
+
+	for _, change := range changes {
+		config, ok := sidecarConfig(change.Path)
+		if !ok || !change.InUpper || dropped[change.Path] || change.UpperType != NodeRegularFile {
+			continue
+		}
+		if effectiveRule(rules, change.Path).Action != PolicyDefault {
+			continue
+		}
+
+		sidecar := Sidecar{Path: change.Path, Config: config}
+		if resolve {
+			var err error
+
+			sidecar, err = resolveSidecar(sidecar, dropped, handled, bases, rules, lowerNew, upper)
+			if err != nil {
+				return nil, nil, fmt.Errorf("can't resolve sidecar %s: %w", change.Path, err)
+			}
+		}
+
+		sidecars = append(sidecars, sidecar)
+	}
+
+	return sidecars, bases, nil
+}
+
+func resolveSidecar(sidecar Sidecar, dropped, handled map[string]bool, bases map[string]string, rules *buildRules, lowerNew, upper string) (Sidecar, error) {
+	sidecarPath := filepath.Join(upper, sidecar.Path)
+	oursPath := filepath.Join(upper, sidecar.Config)
+	theirsPath := filepath.Join(lowerNew, sidecar.Config)
+
+	if !isRegularFile(theirsPath) {
+		sidecar.Reason = "the update doesn't contain " + sidecar.Config
+		return sidecar, nil
+	}
+
+	identical, err := contentsIdentical(sidecarPath, theirsPath)
+	if err != nil {
+		return sidecar, err
+	}
+
+	if identical || dropped[sidecar.Config] || !isRegularFile(oursPath) {
+		// the update contains the version of the sidecar, or the user has
+		// no own version the sidecar could be merged into anymore
+		sidecar.Action = SidecarDropped
+		return sidecar, nil
+	}
+
+	rule := effectiveRule(rules, sidecar.Config)
+	if rule.Action != PolicyDefault && rule.Action != PolicyMerge {
+		sidecar.Reason = fmt.Sprintf("%s is handled with %s", sidecar.Config, rule.Action)
+		return sidecar, nil
+	}
+
+	if handled[sidecar.Config] {
+		sidecar.Reason = sidecar.Config + " is merged on its own"
+		return sidecar, nil
+	}
+
+	if _, ok := mergerForRule(rules, rule, sidecar.Config); !ok {
+		sidecar.Reason = "no merge strategy is configured for " + sidecar.Config
+		return sidecar, nil
+	}
+
+	if _, exists := bases[sidecar.Config]; exists {
+		sidecar.Reason = "another sidecar of " + sidecar.Config + " is merged"
+		return sidecar, nil
+	}
+
+	bases[sidecar.Config] = sidecarPath
+
+	return sidecar, nil
+}
+
+// finishMergedSidecars marks the sidecars mergeChangedFiles used as base as merged if merging
+// their configuration file had no conflicts, and keeps the others
+func finishMergedSidecars(sidecars []Sidecar, bases map[string]string, conflicts []Conflict, upper string) {
+	for i, sidecar := range sidecars {
+		sidecarPath := filepath.Join(upper, sidecar.Path)
+		if sidecar.Action != SidecarKept || bases[sidecar.Config] != sidecarPath {
+			continue
+		}
+
+		if slices.ContainsFunc(conflicts, func(conflict Conflict) bool { return conflict.Path == sidecar.Config }) {
+			sidecars[i].Reason = "merging it had conflicts"
+			continue
+		}
+
+		sidecars[i].Action = SidecarMerged
+	}
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func setupSidecars(t *testing.T) (string, string, string, string) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	files := map[string]string{
+		// the update ships the version of the sidecar
+		filepath.Join(oldSys, "ssh/sshd_config"):         "Port 22\n",
+		filepath.Join(newSys, "ssh/sshd_config"):         "Port 22\nUsePAM yes\n",
+		filepath.Join(oldUser, "ssh/sshd_config"):        "Port 2222\n",
+		filepath.Join(oldUser, "ssh/sshd_config.rpmnew"): "Port 22\nUsePAM yes\n",
+		// the sidecar is the base the user's changes should be merged against
+		filepath.Join(oldSys, "login.defs"):             "UMASK 022\nPASS_MAX_DAYS 90\n",
+		filepath.Join(newSys, "login.defs"):             "UMASK 022\nPASS_MAX_DAYS 90\n",
+		filepath.Join(oldUser, "login.defs"):            "UMASK 077\nPASS_MAX_DAYS 99999\n",
+		filepath.Join(oldUser, "login.defs.pacnew"):     "UMASK 022\nPASS_MAX_DAYS 99999\n",
+		filepath.Join(oldSys, "app.cfg"):                "a\n",
+		filepath.Join(newSys, "app.cfg"):                "a\n",
+		filepath.Join(oldUser, "app.cfg"):               "b\n",
+		filepath.Join(oldUser, "app.cfg.dpkg-dist"):     "c\n",
+		filepath.Join(oldUser, "removed.conf.dpkg-new"): "x\n",
+	}
+	writeFiles(t, files)
+
+	return oldSys, newSys, oldUser, newUser
+}
+
+func TestResolveSidecars(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupSidecars(t)
+
+	options := DefaultBuildOptions()
+	options.ResolveSidecars = true
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Sidecar{
+		{Path: "app.cfg.dpkg-dist", Config: "app.cfg", Action: SidecarKept, Reason: "no merge strategy is configured for app.cfg"},
+		{Path: "login.defs.pacnew", Config: "login.defs", Action: SidecarMerged},
+		{Path: "removed.conf.dpkg-new", Config: "removed.conf", Action: SidecarKept, Reason: "the update doesn't contain removed.conf"},
+		{Path: "ssh/sshd_config.rpmnew", Config: "ssh/sshd_config", Action: SidecarDropped},
+	}
+	if !slices.Equal(report.Sidecars, expected) {
+		t.Errorf("sidecars are %v instead of %v", report.Sidecars, expected)
+	}
+
+	for _, sidecar := range expected {
+		_, err = os.Lstat(filepath.Join(newUser, sidecar.Path))
+		if (err == nil) != (sidecar.Action == SidecarKept) {
+			t.Errorf("%s was not %s", sidecar.Path, sidecar.Action)
+		}
+	}
+
+	contents, err := os.ReadFile(filepath.Join(newUser, "login.defs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "UMASK 077\nPASS_MAX_DAYS 90\n" {
+		t.Errorf("merged login.defs is\n%s", contents)
+	}
+}
+
+func TestReportSidecars(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupSidecars(t)
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Sidecars) != 4 {
+		t.Errorf("found sidecars %v", report.Sidecars)
+	}
+	for _, sidecar := range report.Sidecars {
+		if sidecar.Action != SidecarKept {
+			t.Errorf("%s was %s without resolving sidecars", sidecar.Path, sidecar.Action)
+		}
+
+		_, err = os.Lstat(filepath.Join(newUser, sidecar.Path))
+		if err != nil {
+			t.Errorf("%s was not carried into the new upper", sidecar.Path)
+		}
+	}
+}
+
+func TestSidecarBaseForBothChanged(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	// against the old lower both changed PASS_MAX_DAYS, but the user
+	// only changed UMASK since the version of the sidecar
+	files := map[string]string{
+		filepath.Join(oldSys, "default/passwd"):            "UMASK=022\nPASS_MAX_DAYS=99999\n",
+		filepath.Join(newSys, "default/passwd"):            "UMASK=022\nPASS_MAX_DAYS=90\n",
+		filepath.Join(oldUser, "default/passwd"):           "UMASK=077\nPASS_MAX_DAYS=60\n",
+		filepath.Join(oldUser, "default/passwd.dpkg-dist"): "UMASK=022\nPASS_MAX_DAYS=60\n",
+	}
+	writeFiles(t, files)
+
+	options := DefaultBuildOptions()
+	options.ResolveSidecars = true
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Conflicts) != 0 {
+		t.Errorf("merging with the sidecar as base had conflicts %v", report.Conflicts)
+	}
+	if !slices.Equal(report.Merged, []string{"default/passwd"}) {
+		t.Errorf("merged %v instead of default/passwd", report.Merged)
+	}
+
+	expected := []Sidecar{{Path: "default/passwd.dpkg-dist", Config: "default/passwd", Action: SidecarMerged}}
+	if !slices.Equal(report.Sidecars, expected) {
+		t.Errorf("sidecars are %v instead of %v", report.Sidecars, expected)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(newUser, "default/passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "UMASK=077\nPASS_MAX_DAYS=90\n" {
+		t.Errorf("merged default/passwd is\n%s", contents)
+	}
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+)
+
+// AccountChange is a user or group of the new lower that building
+// the new etc adds to the user's accounts or gives another id
+type AccountChange struct {
+	// Kind is either "user" or "group"
+	Kind string
+	Name string
+	// UpstreamID is the id the new lower uses
+	UpstreamID int
+	// ID is the id the account has in the new upper, files of the new
+	// lower owned by UpstreamID are changed to be owned by it
+	ID int
+	// Added is true if the user doesn't have the account yet
+	Added bool
+}
+
+func (c AccountChange) String() string {
+	switch {
+	case c.Added && c.ID == c.UpstreamID:
+		return fmt.Sprintf("%s %s added with id %d", c.Kind, c.Name, c.ID)
+	case c.Added:
+		return fmt.Sprintf("%s %s added with id %d instead of %d", c.Kind, c.Name, c.ID, c.UpstreamID)
+	default:
+		return fmt.Sprintf("%s %s renumbered from id %d to the user's id %d", c.Kind, c.Name, c.UpstreamID, c.ID)
+	}
+}
+
+// UpdatePreview describes what building a new etc would do
+type UpdatePreview struct {
+	// Warnings are problems that wouldn't stop the build
+	Warnings []error
+	// Changes classifies every path of the upper against the old and new lower
+	Changes ChangeSet
+	// Conflicts are changes of the update that won't be applied in favor of the user's version
+	Conflicts []Conflict
+	// Merged are the files whose update will be merged into the user's version
+	Merged []string
+	// StaleShadows are unmodified copies of the old lower that will be dropped
+	StaleShadows []string
+	// KeptStaleShadows are unmodified copies of the old lower that will be kept, since
+	// the policy keeps them or they are folders containing changes of the user
+	KeptStaleShadows []string
+	// Regenerate are paths of the upper that will be left out since the
+	// new system has to regenerate them, see ExcludeRegenerate
+	Regenerate []string
+	// Sidecars are the sidecars like .rpmnew found in the upper and what will happen to them
+	Sidecars []Sidecar
+	// TypeChanges are paths whose type the update changed while the upper has its own version
+	TypeChanges []TypeChange
+	// Accounts are the users and groups that will be added or renumbered
+	Accounts []AccountChange
+}
+
+// PreviewUpdate works out what BuildNewEtcWithOptions would do with the upper
+// when updating from lowerOld to lowerNew, without writing anything
+func PreviewUpdate(lowerOld, lowerNew, upper string, options BuildOptions) (*UpdatePreview, error) {
+	plan, err := planBuild(lowerOld, lowerNew, upper, options)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := previewAccounts(plan.accounts, lowerNew, upper)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UpdatePreview{
+		Warnings:         plan.warnings,
+		Changes:          plan.changes,
+		Conflicts:        plan.conflicts,
+		Merged:           plan.merged,
+		StaleShadows:     plan.staleShadows,
+		KeptStaleShadows: plan.keptStaleShadows,
+		Regenerate:       plan.regenerate,
+		Sidecars:         plan.sidecars,
+		TypeChanges:      plan.typeChanges,
+		Accounts:         accounts,
+	}, nil
+}
+
+// previewAccounts returns the accounts of the new lower that merging them changes
+func previewAccounts(accounts *mergedAccounts, lowerNew, upper string) ([]AccountChange, error) {
+	changes := []AccountChange{}
+
+	if accounts.hasGroups {
+		userGroups, err := NewGroupFile(filepath.Join(upper, "group"))
+		if err != nil {
+			return nil, fmt.Errorf("can't open current group file: %w", err)
+		}
+		lowerGroups, err := NewGroupFile(filepath.Join(lowerNew, "group"))
+		if err != nil {
+			return nil, fmt.Errorf("can't open new lower group file: %w", err)
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(lowerGroups.Contents)) {
+			gid := lowerGroups.Contents[name].Gid
+			_, exists := userGroups.Contents[name]
+			if !exists || accounts.groupMapping[gid] != gid {
+				changes = append(changes, AccountChange{Kind: "group", Name: name, UpstreamID: gid, ID: accounts.groupMapping[gid], Added: !exists})
+			}
+		}
+	}
+
+	if !accounts.hasUsers {
+		return changes, nil
+	}
+
+	userPasswd, err := NewPasswdFile(filepath.Join(upper, "passwd"))
+	if err != nil {
+		return nil, fmt.Errorf("can't open current passwd file: %w", err)
+	}
+	lowerPasswd, err := NewPasswdFile(filepath.Join(lowerNew, "passwd"))
+	if err != nil {
+		return nil, fmt.Errorf("can't open new lower passwd file: %w", err)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(lowerPasswd.Contents)) {
+		uid := lowerPasswd.Contents[name].Uid
+		_, exists := userPasswd.Contents[name]
+		if !exists || accounts.userMapping[uid] != uid {
+			changes = append(changes, AccountChange{Kind: "user", Name: name, UpstreamID: uid, ID: accounts.userMapping[uid], Added: !exists})
+		}
+	}
+
+	return changes, nil
+}
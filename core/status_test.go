@@ -0,0 +1,185 @@
+package core
+
+import (
+	"crypto/sha256"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// treeDigest returns a digest of every path, mode and contents in root
+func treeDigest(t *testing.T, root string) []byte {
+	hash := sha256.New()
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hash.Write([]byte(path + info.Mode().String()))
+
+		if d.Type().IsRegular() {
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			hash.Write(contents)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash.Sum(nil)
+}
+
+func TestPreviewUpdate(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	files := map[string]string{
+		// merged with the hosts strategy
+		filepath.Join(oldSys, "hosts"):  "127.0.0.1 localhost\n",
+		filepath.Join(newSys, "hosts"):  "127.0.0.1 localhost\n::1 localhost\n",
+		filepath.Join(oldUser, "hosts"): "127.0.0.1 localhost\n192.168.1.2 nas\n",
+		// no strategy to merge it with
+		filepath.Join(oldSys, "motd"):  "welcome\n",
+		filepath.Join(newSys, "motd"):  "welcome to 2.0\n",
+		filepath.Join(oldUser, "motd"): "hello\n",
+		// unmodified copy of the old lower
+		filepath.Join(oldSys, "issue"):  "1.0\n",
+		filepath.Join(newSys, "issue"):  "2.0\n",
+		filepath.Join(oldUser, "issue"): "1.0\n",
+		// the user has video with another gid than the update
+		filepath.Join(oldSys, "group"):  "root:x:0:\nnogroup:x:65534:\n",
+		filepath.Join(newSys, "group"):  "root:x:0:\nvideo:x:44:\nuucp:x:10:\nnogroup:x:65534:\n",
+		filepath.Join(oldUser, "group"): "root:x:0:\nvideo:x:900:\nnogroup:x:65534:\n",
+		// zsh of the image and fish of the user don't exist in the new system
+		filepath.Join(oldSys, "shells"):  "/bin/sh\n/bin/zsh\n",
+		filepath.Join(newSys, "shells"):  "/bin/sh\n/bin/zsh\n/bin/bash\n",
+		filepath.Join(oldUser, "shells"): "/bin/sh\n/bin/zsh\n/bin/fish\n",
+		// merged with the sidecar as base, which is dropped afterwards
+		filepath.Join(oldSys, "default/passwd"):            "UMASK=022\nPASS_MAX_DAYS=99999\n",
+		filepath.Join(newSys, "default/passwd"):            "UMASK=022\nPASS_MAX_DAYS=90\n",
+		filepath.Join(oldUser, "default/passwd"):           "UMASK=077\nPASS_MAX_DAYS=60\n",
+		filepath.Join(oldUser, "default/passwd.dpkg-dist"): "UMASK=022\nPASS_MAX_DAYS=60\n",
+		// regenerated by the new system
+		filepath.Join(oldUser, "ld.so.cache"): "cache",
+	}
+	writeFiles(t, files)
+
+	root := t.TempDir()
+	for _, shell := range []string{"bin/sh", "bin/bash"} {
+		err := os.MkdirAll(filepath.Join(root, filepath.Dir(shell)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, shell), []byte{}, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options := DefaultBuildOptions()
+	options.Root = root
+	options.ResolveSidecars = true
+
+	digests := map[string][]byte{}
+	for _, root := range []string{oldSys, newSys, oldUser} {
+		digests[root] = treeDigest(t, root)
+	}
+
+	preview, err := PreviewUpdate(oldSys, newSys, oldUser, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for root, digest := range digests {
+		if !slices.Equal(treeDigest(t, root), digest) {
+			t.Errorf("%s was changed by the preview", root)
+		}
+	}
+	_, err = os.Lstat(newUser)
+	if err == nil {
+		t.Error("the new upper was created by the preview")
+	}
+
+	if !slices.Equal(preview.Merged, []string{"default/passwd", "hosts"}) {
+		t.Errorf("merged %v instead of default/passwd and hosts", preview.Merged)
+	}
+	if len(preview.Conflicts) != 1 || preview.Conflicts[0].Path != "motd" {
+		t.Errorf("conflicts are %v instead of motd", preview.Conflicts)
+	}
+	if !slices.Equal(preview.StaleShadows, []string{"issue"}) {
+		t.Errorf("stale shadows are %v instead of issue", preview.StaleShadows)
+	}
+	if !slices.Equal(preview.Regenerate, []string{"ld.so.cache"}) {
+		t.Errorf("paths to regenerate are %v instead of ld.so.cache", preview.Regenerate)
+	}
+
+	expectSidecars := []Sidecar{{Path: "default/passwd.dpkg-dist", Config: "default/passwd", Action: SidecarMerged}}
+	if !slices.Equal(preview.Sidecars, expectSidecars) {
+		t.Errorf("sidecars are %v instead of %v", preview.Sidecars, expectSidecars)
+	}
+
+	warnings := []string{}
+	for _, warning := range preview.Warnings {
+		warnings = append(warnings, warning.Error())
+	}
+	expectWarnings := []string{
+		"removed shell /bin/zsh from shells file since it doesn't exist",
+		"kept shell /bin/fish the user added to the shells file although it doesn't exist",
+	}
+	if !slices.Equal(warnings, expectWarnings) {
+		t.Errorf("warnings are %v instead of the missing zsh and fish", warnings)
+	}
+
+	expectAccounts := []AccountChange{
+		{Kind: "group", Name: "uucp", UpstreamID: 10, ID: 10, Added: true},
+		{Kind: "group", Name: "video", UpstreamID: 44, ID: 900},
+		{Kind: "user", Name: "uucp", UpstreamID: 10, ID: 10, Added: true},
+	}
+	if !slices.Equal(preview.Accounts, expectAccounts) {
+		t.Errorf("accounts are %v instead of %v", preview.Accounts, expectAccounts)
+	}
+
+	// the build has to do what the preview showed
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(report.Merged, preview.Merged) {
+		t.Errorf("build merged %v, but the preview showed %v", report.Merged, preview.Merged)
+	}
+	if !slices.Equal(report.Conflicts, preview.Conflicts) {
+		t.Errorf("build had conflicts %v, but the preview showed %v", report.Conflicts, preview.Conflicts)
+	}
+	if !slices.Equal(report.StaleShadows, preview.StaleShadows) {
+		t.Errorf("build dropped %v, but the preview showed %v", report.StaleShadows, preview.StaleShadows)
+	}
+	if !slices.Equal(report.KeptStaleShadows, preview.KeptStaleShadows) {
+		t.Errorf("build kept %v, but the preview showed %v", report.KeptStaleShadows, preview.KeptStaleShadows)
+	}
+	if !slices.Equal(report.Regenerate, preview.Regenerate) {
+		t.Errorf("build left out %v to regenerate, but the preview showed %v", report.Regenerate, preview.Regenerate)
+	}
+	if !slices.Equal(report.Sidecars, preview.Sidecars) {
+		t.Errorf("build resolved sidecars %v, but the preview showed %v", report.Sidecars, preview.Sidecars)
+	}
+	if !slices.Equal(report.TypeChanges, preview.TypeChanges) {
+		t.Errorf("build had type changes %v, but the preview showed %v", report.TypeChanges, preview.TypeChanges)
+	}
+	for _, warning := range warnings {
+		if !slices.ContainsFunc(report.Warnings, func(err error) bool { return err.Error() == warning }) {
+			t.Errorf("build didn't warn about %s like the preview", warning)
+		}
+	}
+}
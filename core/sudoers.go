@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SudoersMerger never merges sudoers files, since a mistake can lock
+// users out of administration. The user's version is always kept and the
+// update's version is reported as a conflict to be reviewed.
+type SudoersMerger struct{}
+
+func (m *SudoersMerger) Merge(base, ours, theirs []byte) ([]byte, []Conflict, error) {
+	return ours, []Conflict{{Reason: "sudoers files are never merged automatically, review the update's version"}}, nil
+}
+
+// SyntaxChecker returns an error if contents aren't valid
+type SyntaxChecker func(contents []byte) error
+
+// SyntaxCheckRule assigns a syntax checker to all paths matching Pattern
+type SyntaxCheckRule struct {
+	// Pattern is matched with path.Match against paths relative to the etc folder
+	Pattern string
+	Checker SyntaxChecker
+}
+
+// SyntaxCheckRules decide which merged files are checked before they are written,
+// if the check fails, the user's version is kept. The first matching rule is used.
+var SyntaxCheckRules = []SyntaxCheckRule{
+	{Pattern: "sudoers", Checker: CheckSudoersSyntax},
+	{Pattern: "sudoers.d/*", Checker: CheckSudoersSyntax},
+}
+
+// SyntaxCheckerFor returns the checker of the first rule matching the relative path
+func SyntaxCheckerFor(relativePath string) (SyntaxChecker, bool) {
+	for _, rule := range SyntaxCheckRules {
+		if matchesPattern(rule.Pattern, relativePath) {
+			return rule.Checker, true
+		}
+	}
+
+	return nil, false
+}
+
+// SudoersSyntaxError describes the first invalid line of a sudoers file
+type SudoersSyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SudoersSyntaxError) Error() string {
+	return fmt.Sprintf("sudoers syntax error in line %d: %s", e.Line, e.Msg)
+}
+
+var (
+	sudoersAliasRegex    = regexp.MustCompile(`^(User_Alias|Runas_Alias|Host_Alias|Cmnd_Alias|Cmd_Alias)\s+(.*)$`)
+	sudoersAliasDefRegex = regexp.MustCompile(`^[A-Z][A-Z0-9_]*\s*=\s*\S`)
+	sudoersDefaultsRegex = regexp.MustCompile(`^Defaults([:@!>]\S+)?(\s+(.*))?$`)
+	sudoersParamRegex    = regexp.MustCompile(`^!*[a-z_]+(\s*[+-]?=\s*.+)?$`)
+	sudoersTagRegex      = regexp.MustCompile(`^[A-Z_]+$`)
+	// separates multiple host and command lists of a user specification
+	sudoersSpecSeparatorRegex = regexp.MustCompile(`\s+:\s+`)
+)
+
+var sudoersTags = map[string]bool{
+	"NOPASSWD": true, "PASSWD": true, "NOEXEC": true, "EXEC": true,
+	"SETENV": true, "NOSETENV": true, "LOG_INPUT": true, "NOLOG_INPUT": true,
+	"LOG_OUTPUT": true, "NOLOG_OUTPUT": true, "MAIL": true, "NOMAIL": true,
+	"FOLLOW": true, "NOFOLLOW": true, "INTERCEPT": true, "NOINTERCEPT": true,
+}
+
+// CheckSudoersSyntax checks contents against the commonly used parts of the
+// sudoers grammar: include directives, Defaults, aliases and user specifications.
+// It is stricter than sudo for unusual constructs, which only means the user's
+// version is kept in doubt.
+func CheckSudoersSyntax(contents []byte) error {
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+
+	for index := 0; index < len(lines); index++ {
+		lineNumber := index + 1
+		line := strings.TrimSpace(lines[index])
+
+		for strings.HasSuffix(line, "\\") {
+			index++
+			if index >= len(lines) {
+				return &SudoersSyntaxError{Line: lineNumber, Msg: "line continuation at end of file"}
+			}
+			line = strings.TrimSpace(strings.TrimSuffix(line, "\\") + " " + strings.TrimSpace(lines[index]))
+		}
+
+		err := checkSudoersLine(line)
+		if err != nil {
+			return &SudoersSyntaxError{Line: lineNumber, Msg: err.Error()}
+		}
+	}
+
+	return nil
+}
+
+func checkSudoersLine(line string) error {
+	if line == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "#include") || strings.HasPrefix(line, "@include") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || (fields[0] != "#include" && fields[0] != "#includedir" && fields[0] != "@include" && fields[0] != "@includedir") {
+			return fmt.Errorf("invalid include directive")
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	if strings.Count(line, "\"")%2 != 0 {
+		return fmt.Errorf("unterminated quote")
+	}
+
+	if matches := sudoersDefaultsRegex.FindStringSubmatch(line); matches != nil {
+		if strings.TrimSpace(matches[3]) == "" {
+			return fmt.Errorf("Defaults without parameters")
+		}
+		for param := range strings.SplitSeq(matches[3], ",") {
+			if !sudoersParamRegex.MatchString(strings.TrimSpace(param)) {
+				return fmt.Errorf("invalid Defaults parameter %q", strings.TrimSpace(param))
+			}
+		}
+		return nil
+	}
+
+	if matches := sudoersAliasRegex.FindStringSubmatch(line); matches != nil {
+		for definition := range strings.SplitSeq(matches[2], ":") {
+			if !sudoersAliasDefRegex.MatchString(strings.TrimSpace(definition)) {
+				return fmt.Errorf("invalid %s definition %q", matches[1], strings.TrimSpace(definition))
+			}
+		}
+		return nil
+	}
+
+	return checkSudoersUserSpec(line)
+}
+
+// checkSudoersUserSpec checks lines like "user host = (runas) TAG: command, command"
+func checkSudoersUserSpec(line string) error {
+	// the fields of a line may be separated by any mix of spaces and tabs
+	end := strings.IndexAny(line, " \t")
+	if end <= 0 {
+		return fmt.Errorf("incomplete user specification")
+	}
+	rest := strings.TrimSpace(line[end:])
+
+	// hosts and commands may be given multiple times separated by ":"
+	for _, spec := range sudoersSpecSeparatorRegex.Split(rest, -1) {
+		hosts, commands, ok := strings.Cut(spec, "=")
+		if !ok || strings.TrimSpace(hosts) == "" {
+			return fmt.Errorf("user specification without host list")
+		}
+
+		commands = strings.TrimSpace(commands)
+
+		if strings.HasPrefix(commands, "(") {
+			end := strings.Index(commands, ")")
+			if end < 0 {
+				return fmt.Errorf("unterminated runas list")
+			}
+			commands = strings.TrimSpace(commands[end+1:])
+		}
+
+		// tags are written as "NAME:" in front of the commands
+		for {
+			tag, after, ok := strings.Cut(commands, ":")
+			if !ok || !sudoersTagRegex.MatchString(tag) {
+				break
+			}
+			if !sudoersTags[tag] {
+				return fmt.Errorf("unknown tag %s", tag)
+			}
+			commands = strings.TrimSpace(after)
+		}
+
+		if commands == "" {
+			return fmt.Errorf("user specification without commands")
+		}
+
+		for command := range strings.SplitSeq(commands, ",") {
+			if strings.TrimSpace(command) == "" {
+				return fmt.Errorf("empty command in command list")
+			}
+		}
+	}
+
+	return nil
+}
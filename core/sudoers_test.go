@@ -0,0 +1,245 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSudoersSyntax(t *testing.T) {
+	valid := []string{
+		"# comment\n\nDefaults\tenv_reset\nDefaults:%wheel !lecture, timestamp_timeout=15\nDefaults secure_path=\"/usr/sbin:/usr/bin\"\n",
+		"root ALL=(ALL:ALL) ALL\n%wheel ALL=(ALL) NOPASSWD: ALL\n",
+		"User_Alias ADMINS = alice, bob : WEB = carol\nCmnd_Alias REBOOT = /usr/bin/systemctl reboot, \\\n\t/usr/bin/systemctl poweroff\nADMINS ALL = REBOOT\n",
+		"@includedir /etc/sudoers.d\n#includedir /etc/sudoers.d\n",
+		"alice laptop = (root) NOPASSWD: SETENV: /usr/bin/apt : server = (www) /usr/bin/vim\n",
+	}
+	invalid := []string{
+		"root ALL=(ALL:ALL\n",
+		"%wheel ALL=(ALL) NOPASSWORD: ALL\n",
+		"root ALL=\n",
+		"Defaults\n",
+		"User_Alias admins = alice\n",
+		"Defaults secure_path=\"/usr/bin\n",
+		"Cmnd_Alias A = /bin/a, \\\n",
+		"@include\n",
+	}
+
+	for _, contents := range valid {
+		err := CheckSudoersSyntax([]byte(contents))
+		if err != nil {
+			t.Errorf("valid sudoers %q was rejected: %s", contents, err)
+		}
+	}
+
+	for _, contents := range invalid {
+		err := CheckSudoersSyntax([]byte(contents))
+		if err == nil {
+			t.Errorf("invalid sudoers %q was accepted", contents)
+		}
+	}
+}
+
+// verbatim sudoers of Debian 12, shortened to its non-comment lines and a few comments
+const sudoersDebian = `#
+# This file MUST be edited with the 'visudo' command as root.
+#
+# Please consider adding local content in /etc/sudoers.d/ instead of
+# directly modifying this file.
+#
+# See the man page for details on how to write a sudoers file.
+#
+Defaults	env_reset
+Defaults	mail_badpass
+Defaults	secure_path="/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+# This fixes CVE-2005-4890 and possibly breaks some versions of kdesu
+# (https://bugs.kali.org/view.php?id=4234)
+Defaults	use_pty
+
+# This preserves proxy settings from user environments of root
+# equivalent users (group sudo)
+#Defaults:%sudo env_keep += "http_proxy https_proxy ftp_proxy all_proxy no_proxy"
+
+# Host alias specification
+
+# User alias specification
+
+# Cmnd alias specification
+
+# User privilege specification
+root	ALL=(ALL:ALL) ALL
+
+# Allow members of group sudo to execute any command
+%sudo	ALL=(ALL:ALL) ALL
+
+# See sudoers(5) for more information on "@include" directives:
+
+@includedir /etc/sudoers.d
+`
+
+// verbatim sudoers of Fedora 40, shortened like sudoersDebian
+const sudoersFedora = `## Sudoers allows particular users to run various commands as
+## the root user, without needing the root password.
+##
+## This file must be edited with the 'visudo' command.
+
+## Host Aliases
+## Groups of machines. You may prefer to use hostnames (perhaps using 
+## wildcards for entire domains) or IP addresses instead.
+# Host_Alias     FILESERVERS = fs1, fs2
+# Host_Alias     MAILSERVERS = smtp, smtp2
+
+## Command Aliases
+# Cmnd_Alias NETWORKING = /sbin/route, /sbin/ifconfig, /bin/ping, /sbin/dhclient, /usr/bin/net, /sbin/iptables, /usr/bin/rfcomm, /usr/bin/wvdial, /sbin/iwconfig, /sbin/mii-tool
+
+Defaults   !visiblepw
+
+Defaults    always_set_home
+Defaults    match_group_by_gid
+
+Defaults    always_query_group_plugin
+
+Defaults    env_reset
+Defaults    env_keep =  "COLORS DISPLAY HOSTNAME HISTSIZE KDEDIR LS_COLORS"
+Defaults    env_keep += "MAIL QTDIR USERNAME LANG LC_ADDRESS LC_CTYPE"
+Defaults    env_keep += "LC_COLLATE LC_IDENTIFICATION LC_MEASUREMENT LC_MESSAGES"
+Defaults    env_keep += "LC_MONETARY LC_NAME LC_NUMERIC LC_PAPER LC_TELEPHONE"
+Defaults    env_keep += "LC_TIME LC_ALL LANGUAGE LINGUAS _XKB_CHARSET XAUTHORITY"
+
+Defaults    secure_path = /sbin:/bin:/usr/sbin:/usr/bin
+
+## Allow root to run any commands anywhere 
+root	ALL=(ALL) 	ALL
+
+## Allows people in group wheel to run all commands
+%wheel	ALL=(ALL)	ALL
+
+## Same thing without a password
+# %wheel	ALL=(ALL)	NOPASSWD: ALL
+
+## Allows members of the users group to mount and unmount the 
+## cdrom as root
+# %users  ALL=/sbin/mount /mnt/cdrom, /sbin/umount /mnt/cdrom
+
+## Read drop-in files from /etc/sudoers.d (the # here does not mean a comment)
+#includedir /etc/sudoers.d
+`
+
+func TestCheckSudoersSyntaxDistributions(t *testing.T) {
+	for name, contents := range map[string]string{"debian": sudoersDebian, "fedora": sudoersFedora} {
+		err := CheckSudoersSyntax([]byte(contents))
+		if err != nil {
+			t.Errorf("sudoers of %s was rejected: %s", name, err)
+		}
+	}
+
+	tabs := []string{"root\tALL=(ALL:ALL) ALL\n", "%wheel\tALL=(ALL)\tALL\n", "alice\tlaptop = (root) /usr/bin/apt\t:\tserver = ALL\n"}
+	for _, contents := range tabs {
+		err := CheckSudoersSyntax([]byte(contents))
+		if err != nil {
+			t.Errorf("sudoers %q separated with tabs was rejected: %s", contents, err)
+		}
+	}
+}
+
+func TestSudoersNotMerged(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	files := map[string]string{
+		filepath.Join(oldSys, "sudoers"):  "root ALL=(ALL:ALL) ALL\n",
+		filepath.Join(newSys, "sudoers"):  "root ALL=(ALL:ALL) ALL\n@includedir /etc/sudoers.d\n",
+		filepath.Join(oldUser, "sudoers"): "root ALL=(ALL:ALL) ALL\n%wheel ALL=(ALL) ALL\n",
+	}
+	writeFiles(t, files)
+	chmodFiles(t, map[string]os.FileMode{
+		filepath.Join(oldSys, "sudoers"):  0o440,
+		filepath.Join(newSys, "sudoers"):  0o440,
+		filepath.Join(oldUser, "sudoers"): 0o440,
+	})
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(newUser, "sudoers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != files[filepath.Join(oldUser, "sudoers")] {
+		t.Errorf("user's sudoers was changed to\n%s", contents)
+	}
+
+	info, err := os.Lstat(filepath.Join(newUser, "sudoers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o440 {
+		t.Errorf("Permissions %o instead of %o", info.Mode().Perm(), 0o440)
+	}
+
+	found := false
+	for _, conflict := range report.Conflicts {
+		if conflict.Path == "sudoers" && conflict.Upstream == filepath.Join(newSys, "sudoers") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("sudoers is not reported as pending conflict: %v", report.Conflicts)
+	}
+}
+
+func TestInvalidMergeRejected(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, map[string]string{
+		filepath.Join(dir, "base"):   "root ALL=(ALL:ALL) ALL\n",
+		filepath.Join(dir, "ours"):   "root ALL=(ALL:ALL) ALL\n%wheel ALL=(ALL) ALL\n",
+		filepath.Join(dir, "theirs"): "root ALL=(ALL:ALL) ALL\n%sudo ALL=(ALL\n",
+	})
+
+	merger, _ := GetMergeStrategy("lineset")
+	changed, conflicts, err := MergeFiles(merger, CheckSudoersSyntax, filepath.Join(dir, "base"), filepath.Join(dir, "ours"), filepath.Join(dir, "theirs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed || len(conflicts) != 1 {
+		t.Errorf("invalid merge result was accepted, conflicts: %v", conflicts)
+	}
+}
+
+func TestInvalidMergeKeepsConflicts(t *testing.T) {
+	dir := t.TempDir()
+	merger := &KeyValueMerger{Dialect: KeyValueWhitespace, CommentPrefixes: "#"}
+
+	// both change Defaults and the update adds a broken line
+	writeFiles(t, map[string]string{
+		filepath.Join(dir, "base"):   "Defaults env_reset\nroot ALL=(ALL:ALL) ALL\n",
+		filepath.Join(dir, "ours"):   "Defaults !env_reset\nroot ALL=(ALL:ALL) ALL\n",
+		filepath.Join(dir, "theirs"): "Defaults env_keep\nroot ALL=(ALL:ALL) ALL\n%sudo ALL=(ALL\n",
+	})
+
+	changed, conflicts, err := MergeFiles(merger, CheckSudoersSyntax, filepath.Join(dir, "base"), filepath.Join(dir, "ours"), filepath.Join(dir, "theirs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || len(conflicts) != 2 {
+		t.Errorf("conflicts of the merger were not kept: %v", conflicts)
+	}
+
+	// an unchanged user version isn't checked, even if it's invalid
+	writeFiles(t, map[string]string{
+		filepath.Join(dir, "ours"):   "Defaults !env_reset\nroot ALL=(ALL\n",
+		filepath.Join(dir, "theirs"): "Defaults env_keep\nroot ALL=(ALL:ALL) ALL\n",
+	})
+
+	changed, conflicts, err = MergeFiles(merger, CheckSudoersSyntax, filepath.Join(dir, "base"), filepath.Join(dir, "ours"), filepath.Join(dir, "theirs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || len(conflicts) != 1 || strings.Contains(conflicts[0].Reason, "invalid") {
+		t.Errorf("unchanged user version was checked, conflicts: %v", conflicts)
+	}
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// EtcLocation is where the etc folders are mounted on the running system,
+// relative symlink targets are resolved against it
+var EtcLocation = "/etc"
+
+// RuntimeLocations are filesystems that only have contents on the running system,
+// symlinks pointing into them can't be checked in the root of the new system
+var RuntimeLocations = []string{"/run", "/var/run", "/proc", "/sys", "/dev", "/tmp"}
+
+// DanglingSymlink is a symlink of the user that points to a path
+// which doesn't exist in the new system
+type DanglingSymlink struct {
+	// Path is the path of the symlink relative to the etc folders
+	Path   string
+	Target string
+}
+
+func (d DanglingSymlink) String() string {
+	return fmt.Sprintf("%s points to %s, which doesn't exist", d.Path, d.Target)
+}
+
+// normalizeSymlinkTarget turns target into a clean absolute path, relative targets
+// are resolved against the folder of location. If location is empty, target is
+// only cleaned.
+func normalizeSymlinkTarget(location, target string) string {
+	if location == "" || filepath.IsAbs(target) {
+		return filepath.Clean(target)
+	}
+
+	return filepath.Join(filepath.Dir(location), target)
+}
+
+// findDanglingSymlinks checks where the symlinks in the new upper point to.
+//
+// Paths inside EtcLocation are looked up in the new upper and the new lower etc
+// like in the overlay, all other paths in root. Symlinks that lead into one of the
+// RuntimeLocations aren't reported, like resolv.conf pointing into /run.
+func findDanglingSymlinks(upperNew, lowerNew, root string) ([]DanglingSymlink, error) {
+	entries, err := walkTree(upperNew)
+	if err != nil {
+		return nil, fmt.Errorf("can't search for dangling symlinks: %w", err)
+	}
+
+	inRuntime := false
+	locate := func(path string) string {
+		if slices.ContainsFunc(RuntimeLocations, func(location string) bool { return isInside(location, path) }) {
+			inRuntime = true
+		}
+
+		if !isInside(EtcLocation, path) {
+			return filepath.Join(root, path)
+		}
+		inEtc, _ := filepath.Rel(EtcLocation, path)
+
+		upperPath := filepath.Join(upperNew, inEtc)
+		if _, err := os.Lstat(upperPath); err == nil {
+			return upperPath
+		}
+		return filepath.Join(lowerNew, inEtc)
+	}
+
+	dangling := []DanglingSymlink{}
+
+	for _, entry := range entries {
+		if entry.entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		target, err := os.Readlink(filepath.Join(upperNew, entry.path))
+		if err != nil {
+			return nil, fmt.Errorf("can't read symlink \"%s\": %w", entry.path, err)
+		}
+
+		inRuntime = false
+		_, err = resolveWith(locate, normalizeSymlinkTarget(filepath.Join(EtcLocation, entry.path), target))
+		if err != nil && !inRuntime {
+			dangling = append(dangling, DanglingSymlink{Path: entry.path, Target: target})
+		}
+	}
+
+	return dangling, nil
+}
+
+// isInside checks if path is folder or inside of it
+func isInside(folder, path string) bool {
+	relative, err := filepath.Rel(folder, path)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, "../")
+}
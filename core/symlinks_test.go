@@ -0,0 +1,108 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		location string
+		target   string
+		expect   string
+	}{
+		{"/etc/localtime", "../usr/share/zoneinfo/UTC", "/usr/share/zoneinfo/UTC"},
+		{"/etc/localtime", "/usr/share/zoneinfo//UTC", "/usr/share/zoneinfo/UTC"},
+		{"/etc/alternatives/editor", "../../usr/bin/vim", "/usr/bin/vim"},
+		{"/etc/resolv.conf", "../run/systemd/resolve/stub-resolv.conf", "/run/systemd/resolve/stub-resolv.conf"},
+		{"", "../usr/bin/vim", "../usr/bin/vim"},
+	}
+
+	for _, test := range tests {
+		normalized := normalizeSymlinkTarget(test.location, test.target)
+		if normalized != test.expect {
+			t.Errorf("%s -> %s was normalized to %s instead of %s", test.location, test.target, normalized, test.expect)
+		}
+	}
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	root := t.TempDir()
+	for _, path := range []string{"usr/share/zoneinfo/UTC", "usr/share/zoneinfo/Europe/Berlin", "usr/bin/vim.basic", "usr/bin/nvim"} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, path), []byte{}, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		// the user repointed localtime and the update changed it as well
+		filepath.Join(oldSys, "localtime"):  "/usr/share/zoneinfo/UTC",
+		filepath.Join(newSys, "localtime"):  "../usr/share/zoneinfo/Etc/UTC",
+		filepath.Join(oldUser, "localtime"): "../usr/share/zoneinfo/Europe/Berlin",
+		// only the update changed the alternative, the user's copy is written differently
+		filepath.Join(oldSys, "alternatives/editor"):  "/usr/bin/vim.tiny",
+		filepath.Join(newSys, "alternatives/editor"):  "/usr/bin/vim.basic",
+		filepath.Join(oldUser, "alternatives/editor"): "../../usr/bin/vim.tiny",
+		// the user's alternative points to a program the new system doesn't have
+		filepath.Join(oldSys, "alternatives/pager"):  "/usr/bin/less",
+		filepath.Join(newSys, "alternatives/pager"):  "/usr/bin/less",
+		filepath.Join(oldUser, "alternatives/pager"): "/usr/bin/most",
+		// links inside etc are checked against the new etc
+		filepath.Join(oldUser, "vimrc"): "alternatives/editor",
+		// links into runtime filesystems can't be checked in the root
+		filepath.Join(oldUser, "resolv.conf"): "../run/systemd/resolve/stub-resolv.conf",
+		filepath.Join(oldUser, "mtab"):        "../proc/self/mounts",
+	}
+
+	for link, target := range links {
+		err := os.MkdirAll(filepath.Dir(link), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Symlink(target, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options := DefaultBuildOptions()
+	options.Root = root
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := os.Readlink(filepath.Join(newUser, "localtime"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != links[filepath.Join(oldUser, "localtime")] {
+		t.Errorf("user's localtime was changed to %s", target)
+	}
+	if len(report.Conflicts) != 0 {
+		t.Errorf("repointed symlink is reported as conflict: %v", report.Conflicts)
+	}
+
+	if !slices.Contains(report.StaleShadows, "alternatives/editor") {
+		t.Errorf("unchanged alternative written relatively is not a stale shadow: %v", report.StaleShadows)
+	}
+	_, err = os.Lstat(filepath.Join(newUser, "alternatives/editor"))
+	if err == nil {
+		t.Error("alternative changed by the update doesn't follow the update")
+	}
+
+	expected := []DanglingSymlink{{Path: "alternatives/pager", Target: "/usr/bin/most"}}
+	if !slices.Equal(report.DanglingSymlinks, expected) {
+		t.Errorf("dangling symlinks are %v instead of %v", report.DanglingSymlinks, expected)
+	}
+}
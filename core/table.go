@@ -0,0 +1,88 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TableMerger merges files with one whitespace separated record per line,
+// like fstab or crypttab.
+//
+// Records are identified by a key and merged like the keys of a KeyValueMerger,
+// a record counts as changed if any of its fields changed. The lines are kept as
+// they are, so the user's column alignment isn't lost. Keys that appear more than
+// once in the user's or the updated version are reported as conflicts.
+type TableMerger struct {
+	// Key returns the key of a record, records with an empty key are kept like comments
+	Key func(fields []string) string
+	// KeyName describes the key in conflict messages
+	KeyName         string
+	CommentPrefixes string
+}
+
+func (m *TableMerger) parse(contents []byte) ([]keyValueLine, []string) {
+	lines := []keyValueLine{}
+	duplicates := []string{}
+	seen := make(map[string]bool)
+
+	if len(contents) == 0 {
+		return lines, duplicates
+	}
+
+	for raw := range strings.SplitSeq(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		fields := strings.Fields(raw)
+		line := keyValueLine{raw: raw}
+
+		if len(fields) != 0 && !strings.ContainsAny(fields[0][:1], m.CommentPrefixes) {
+			line.key = m.Key(fields)
+			line.value = strings.Join(fields, " ")
+		}
+
+		if line.key != "" {
+			if seen[line.key] {
+				duplicates = append(duplicates, line.key)
+			}
+			seen[line.key] = true
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, duplicates
+}
+
+func (m *TableMerger) Merge(base, ours, theirs []byte) ([]byte, []Conflict, error) {
+	baseLines, _ := m.parse(base)
+	oursLines, oursDuplicates := m.parse(ours)
+	theirsLines, theirsDuplicates := m.parse(theirs)
+
+	merged, conflicts := mergeKeyedLines(baseLines, oursLines, theirsLines, m.KeyName)
+
+	for _, duplicate := range oursDuplicates {
+		conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("%s %s is used more than once by the user", m.KeyName, duplicate)})
+	}
+	for _, duplicate := range theirsDuplicates {
+		conflicts = append(conflicts, Conflict{Reason: fmt.Sprintf("%s %s is used more than once by the update", m.KeyName, duplicate)})
+	}
+
+	return joinKeyedLines(merged), conflicts, nil
+}
+
+// fstabKey identifies fstab entries by their mount point, swap has no
+// mount point, so it is identified by its device instead
+func fstabKey(fields []string) string {
+	if len(fields) < 2 {
+		return ""
+	}
+
+	if len(fields) >= 3 && fields[2] == "swap" {
+		return "swap:" + fields[0]
+	}
+
+	return fields[1]
+}
+
+// crypttabKey identifies crypttab entries by the name of the mapped device
+func crypttabKey(fields []string) string {
+	return fields[0]
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// TypeChangePolicy decides what happens to user versions of paths
+// whose type the update changed
+type TypeChangePolicy int
+
+const (
+	// TypeChangesKeepUser follows the update if the user's version is unmodified,
+	// otherwise the user's version is kept and reported as conflict
+	TypeChangesKeepUser TypeChangePolicy = iota
+	// TypeChangesPreferUpstream always follows the update, modified user versions
+	// are dropped from the new upper but stay available in the old upper
+	TypeChangesPreferUpstream
+)
+
+// TypeChange is a path whose type the update changed while
+// the upper contained a version of the old type
+type TypeChange struct {
+	Path string
+	From NodeType
+	To   NodeType
+	// KeptUser is true if the user's version was kept and hides the update
+	KeptUser bool
+}
+
+func (c TypeChange) String() string {
+	resolution := "following the update"
+	if c.KeptUser {
+		resolution = "keeping the user's version"
+	}
+
+	return fmt.Sprintf("%s was changed from a %s to a %s by the update, %s", c.Path, c.From, c.To, resolution)
+}
+
+// droppedByTypeChange returns the paths of the upper that the policy drops because the
+// update changed their type or the type of one of their parents
+func droppedByTypeChange(changes ChangeSet, policy TypeChangePolicy) map[string]bool {
+	dropped := make(map[string]bool)
+	if policy != TypeChangesPreferUpstream {
+		return dropped
+	}
+
+	// parents are sorted before their children, so they are decided first
+	for _, change := range changes {
+		if change.InUpper && (change.MasksTypeChange() || dropped[filepath.Dir(change.Path)]) {
+			dropped[change.Path] = true
+		}
+	}
+
+	return dropped
+}
+
+// resolveTypeChanges reports all paths whose type the update changed while the upper
+// had its own version, the ones that weren't dropped from the new upper are conflicts
+// unless the policy keeps the user's version anyway
+func resolveTypeChanges(changes ChangeSet, dropped map[string]bool, rules *buildRules, lowerNew string) ([]TypeChange, []Conflict) {
+	typeChanges := []TypeChange{}
+	conflicts := []Conflict{}
+
+	for _, change := range changes {
+		rule := effectiveRule(rules, change.Path)
+		if !change.MasksTypeChange() || rule.Action == PolicyIgnore {
+			continue
+		}
+
+		typeChange := TypeChange{Path: change.Path, From: change.OldType, To: change.NewType, KeptUser: !dropped[change.Path]}
+		typeChanges = append(typeChanges, typeChange)
+
+		if typeChange.KeptUser && rule.Action != PolicyKeepUser {
+			conflicts = append(conflicts, Conflict{
+				Path:     change.Path,
+				Reason:   fmt.Sprintf("the update changed it from a %s to a %s, keeping the user's %s", change.OldType, change.NewType, change.UpperType),
+				Upstream: filepath.Join(lowerNew, change.Path),
+			})
+		}
+	}
+
+	return typeChanges, conflicts
+}
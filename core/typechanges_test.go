@@ -0,0 +1,152 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// setupTypeChanges creates paths whose type the update changes:
+// resolv.conf with an unmodified user copy, hosts.allow and profile.local
+// with modified user versions and a folder that became a file
+func setupTypeChanges(t *testing.T) (string, string, string, string) {
+	oldSys, newSys, oldUser, newUser := setupEnvironment(t)
+
+	files := map[string]string{
+		filepath.Join(oldSys, "resolv.conf"):         "nameserver 1.1.1.1\n",
+		filepath.Join(oldUser, "resolv.conf"):        "nameserver 1.1.1.1\n",
+		filepath.Join(oldSys, "hosts.allow"):         "ALL: LOCAL\n",
+		filepath.Join(oldUser, "hosts.allow"):        "ALL: LOCAL\nsshd: 10.0.0.0/8\n",
+		filepath.Join(oldSys, "profile.local"):       "umask 022\n",
+		filepath.Join(newSys, "profile.local/00.sh"): "umask 022\n",
+		filepath.Join(oldUser, "profile.local"):      "umask 077\n",
+		filepath.Join(oldSys, "modules.d/a.conf"):    "a\n",
+		filepath.Join(oldUser, "modules.d/a.conf"):   "mine\n",
+		filepath.Join(newSys, "modules.d"):           "a\n",
+		filepath.Join(oldSys, "unchanged.d/a.conf"):  "a\n",
+		filepath.Join(newSys, "unchanged.d/a.conf"):  "a\n",
+		filepath.Join(oldUser, "unchanged.d/b.conf"): "b\n",
+	}
+	writeFiles(t, files)
+
+	for _, link := range []string{"resolv.conf", "hosts.allow"} {
+		err := os.Symlink("../run/"+link, filepath.Join(newSys, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return oldSys, newSys, oldUser, newUser
+}
+
+func TestTypeChangesKeepUser(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupTypeChanges(t)
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, DefaultBuildOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TypeChange{
+		{Path: "hosts.allow", From: NodeRegularFile, To: NodeSymlink, KeptUser: true},
+		{Path: "modules.d", From: NodeFolder, To: NodeRegularFile, KeptUser: true},
+		{Path: "profile.local", From: NodeRegularFile, To: NodeFolder, KeptUser: true},
+		{Path: "resolv.conf", From: NodeRegularFile, To: NodeSymlink, KeptUser: false},
+	}
+	if !slices.Equal(report.TypeChanges, expected) {
+		t.Errorf("type changes are %v instead of %v", report.TypeChanges, expected)
+	}
+
+	_, err = os.Lstat(filepath.Join(newUser, "resolv.conf"))
+	if err == nil {
+		t.Error("unmodified copy hides the type change of the update")
+	}
+
+	for _, path := range []string{"hosts.allow", "modules.d", "profile.local"} {
+		change, _ := report.Changes.Get(path)
+
+		info, err := os.Lstat(filepath.Join(newUser, path))
+		if err != nil {
+			t.Fatalf("user version of %s was removed: %s", path, err)
+		}
+		if nodeTypeOf(info) != change.UpperType {
+			t.Errorf("user version of %s is a %s instead of a %s", path, nodeTypeOf(info), change.UpperType)
+		}
+
+		conflicts := 0
+		for _, conflict := range report.Conflicts {
+			if conflict.Path == path {
+				conflicts++
+			}
+		}
+		if conflicts != 1 {
+			t.Errorf("%s has %d conflicts instead of 1: %v", path, conflicts, report.Conflicts)
+		}
+	}
+
+	if slices.ContainsFunc(report.TypeChanges, func(change TypeChange) bool { return change.Path == "unchanged.d" }) {
+		t.Error("folder without type change is reported")
+	}
+}
+
+func TestTypeChangesPreferUpstream(t *testing.T) {
+	oldSys, newSys, oldUser, newUser := setupTypeChanges(t)
+
+	options := DefaultBuildOptions()
+	options.TypeChanges = TypeChangesPreferUpstream
+
+	report, err := BuildNewEtcWithOptions(oldSys, oldUser, newSys, newUser, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, change := range report.TypeChanges {
+		if change.KeptUser {
+			t.Errorf("user version of %s was kept", change.Path)
+		}
+	}
+	if len(report.Conflicts) != 0 {
+		t.Errorf("conflicts reported: %v", report.Conflicts)
+	}
+
+	for _, path := range []string{"resolv.conf", "hosts.allow", "modules.d", "modules.d/a.conf", "profile.local"} {
+		_, err = os.Lstat(filepath.Join(newUser, path))
+		if err == nil {
+			t.Errorf("user version of %s hides the type change of the update", path)
+		}
+	}
+
+	_, err = os.Lstat(filepath.Join(newUser, "unchanged.d/b.conf"))
+	if err != nil {
+		t.Errorf("file in a folder without type change was removed: %s", err)
+	}
+}
+
+func TestCleanupTypeMismatch(t *testing.T) {
+	target := t.TempDir()
+	base := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(base, "real"), []byte("data"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("real", filepath.Join(base, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(target, "file"), []byte("data"), 0o777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RemoveIdenticalFiles(target, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Lstat(filepath.Join(target, "file"))
+	if err != nil {
+		t.Error("regular file was removed because a symlink with the same contents exists in base")
+	}
+}
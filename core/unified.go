@@ -0,0 +1,216 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContextLines = 3
+
+// diffOp is a single line of an edit script, kind is ' ' for lines both
+// versions contain, '-' for removed and '+' for added lines
+type diffOp struct {
+	kind byte
+	line string
+	// aLine and bLine are the indexes of the line in both versions
+	aLine int
+	bLine int
+}
+
+// editScript finds the shortest edit script turning a into b with the linear space
+// variant of the algorithm from Myers' "An O(ND) Difference Algorithm and Its Variations":
+// the middle snake of the script is searched from both ends and the parts before and
+// after it are solved the same way, so only O(N+M) memory is needed.
+func editScript(a, b []string) []diffOp {
+	script := &editScriptBuilder{a: a, b: b, ops: []diffOp{}}
+	script.compare(0, len(a), 0, len(b))
+
+	return script.ops
+}
+
+type editScriptBuilder struct {
+	a   []string
+	b   []string
+	ops []diffOp
+}
+
+// compare appends the edit script turning a[aStart:aEnd] into b[bStart:bEnd]
+func (s *editScriptBuilder) compare(aStart, aEnd, bStart, bEnd int) {
+	// lines both start or end with are kept as they are
+	for aStart < aEnd && bStart < bEnd && s.a[aStart] == s.b[bStart] {
+		s.ops = append(s.ops, diffOp{kind: ' ', line: s.a[aStart], aLine: aStart, bLine: bStart})
+		aStart++
+		bStart++
+	}
+	suffix := 0
+	for aStart < aEnd-suffix && bStart < bEnd-suffix && s.a[aEnd-suffix-1] == s.b[bEnd-suffix-1] {
+		suffix++
+	}
+	aEnd -= suffix
+	bEnd -= suffix
+
+	switch {
+	case aStart == aEnd:
+		for y := bStart; y < bEnd; y++ {
+			s.ops = append(s.ops, diffOp{kind: '+', line: s.b[y], aLine: aStart, bLine: y})
+		}
+	case bStart == bEnd:
+		for x := aStart; x < aEnd; x++ {
+			s.ops = append(s.ops, diffOp{kind: '-', line: s.a[x], aLine: x, bLine: bStart})
+		}
+	default:
+		// both sides differ at their first and last line, so the script has at least
+		// two edits and the middle snake splits it into two shorter ones
+		x, y, u, v := s.middleSnake(aStart, aEnd, bStart, bEnd)
+		s.compare(aStart, x, bStart, y)
+		for ; x < u; x, y = x+1, y+1 {
+			s.ops = append(s.ops, diffOp{kind: ' ', line: s.a[x], aLine: x, bLine: y})
+		}
+		s.compare(u, aEnd, v, bEnd)
+	}
+
+	for i := range suffix {
+		s.ops = append(s.ops, diffOp{kind: ' ', line: s.a[aEnd+i], aLine: aEnd + i, bLine: bEnd + i})
+	}
+}
+
+// middleSnake returns the start (x, y) and end (u, v) of the snake in the middle of the
+// shortest edit script turning a[aStart:aEnd] into b[bStart:bEnd]
+func (s *editScriptBuilder) middleSnake(aStart, aEnd, bStart, bEnd int) (int, int, int, int) {
+	n, m := aEnd-aStart, bEnd-bStart
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+
+	// forward[k] is the furthest x on diagonal k = x - y from the start, backward[c] the
+	// furthest distance from the end on diagonal c = (n - x) - (m - y), both at index +offset
+	offset := maxD + 1
+	forward := make([]int, 2*maxD+3)
+	backward := make([]int, 2*maxD+3)
+
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+
+			for x < n && y < m && s.a[aStart+x] == s.b[bStart+y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+
+			c := delta - k
+			if odd && c >= -(d-1) && c <= d-1 && x+backward[offset+c] >= n {
+				return aStart + startX, bStart + startY, aStart + x, bStart + y
+			}
+		}
+
+		for c := -d; c <= d; c += 2 {
+			var x int
+			if c == -d || (c != d && backward[offset+c-1] < backward[offset+c+1]) {
+				x = backward[offset+c+1]
+			} else {
+				x = backward[offset+c-1] + 1
+			}
+			y := x - c
+			startX, startY := x, y
+
+			for x < n && y < m && s.a[aEnd-x-1] == s.b[bEnd-y-1] {
+				x++
+				y++
+			}
+			backward[offset+c] = x
+
+			k := delta - c
+			if !odd && k >= -d && k <= d && x+forward[offset+k] >= n {
+				return aEnd - x, bEnd - y, aEnd - startX, bEnd - startY
+			}
+		}
+	}
+
+	// not reached, the snakes always meet within maxD steps
+	return aStart, bStart, aStart, bStart
+}
+
+// unifiedDiff returns the differences between a and b in the unified format
+// with three lines of context, or an empty string if they are the same
+func unifiedDiff(aName, bName, a, b string) string {
+	ops := editScript(diffLines(a), diffLines(b))
+
+	builder := strings.Builder{}
+
+	for start := 0; start < len(ops); {
+		// find the next change and the end of its hunk
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+
+		last := first
+		for next := first; next < len(ops); next++ {
+			if ops[next].kind != ' ' {
+				last = next
+			} else if next-last > 2*diffContextLines {
+				break
+			}
+		}
+
+		hunkStart := max(first-diffContextLines, start)
+		hunkEnd := min(last+diffContextLines+1, len(ops))
+
+		if builder.Len() == 0 {
+			fmt.Fprintf(&builder, "--- %s\n+++ %s\n", aName, bName)
+		}
+		writeHunk(&builder, ops[hunkStart:hunkEnd])
+
+		start = hunkEnd
+	}
+
+	return builder.String()
+}
+
+func writeHunk(builder *strings.Builder, ops []diffOp) {
+	aCount, bCount := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			aCount++
+		}
+		if op.kind != '-' {
+			bCount++
+		}
+	}
+
+	// empty ranges start at the line before them
+	aStart, bStart := ops[0].aLine+1, ops[0].bLine+1
+	if aCount == 0 {
+		aStart--
+	}
+	if bCount == 0 {
+		bStart--
+	}
+
+	fmt.Fprintf(builder, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+	for _, op := range ops {
+		builder.WriteByte(op.kind)
+		builder.WriteString(op.line)
+		builder.WriteByte('\n')
+	}
+}
+
+// diffLines splits contents into lines without the empty line after the last newline
+func diffLines(contents string) []string {
+	if contents == "" {
+		return []string{}
+	}
+
+	return strings.Split(strings.TrimSuffix(contents, "\n"), "\n")
+}
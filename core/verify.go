@@ -0,0 +1,439 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Severity tells how serious a finding of VerifyEtc is
+type Severity int
+
+const (
+	// SeverityWarning is something unusual that works, but should be looked at
+	SeverityWarning Severity = iota
+	// SeverityError is something that breaks the system or its security
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finding is a problem VerifyEtc found in an etc
+type Finding struct {
+	Severity Severity `json:"severity"`
+	// Path is the path relative to the etc folders the finding is about
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Severity, f.Path, f.Message)
+}
+
+// ModeRule assigns the permissions files matching Pattern may have
+type ModeRule struct {
+	// Pattern is matched with path.Match against paths relative to the etc folder
+	Pattern string
+	Modes   []fs.FileMode
+}
+
+// ModeRules are the permissions VerifyEtc expects for sensitive files, the first matching rule is used
+var ModeRules = []ModeRule{
+	{Pattern: "shadow", Modes: []fs.FileMode{0o640, 0o000}},
+	{Pattern: "gshadow", Modes: []fs.FileMode{0o640, 0o000}},
+	{Pattern: "sudoers", Modes: []fs.FileMode{0o440}},
+	{Pattern: "sudoers.d/*", Modes: []fs.FileMode{0o440}},
+}
+
+// NoLoginShells are the names of shells that deny logins,
+// they don't have to be listed in the shells file
+var NoLoginShells = []string{"nologin", "false"}
+
+// etcView is an etc made of a lower and an optional upper like overlayfs shows it
+type etcView struct {
+	lower string
+	upper string
+}
+
+type etcViewEntry struct {
+	path string
+	info os.FileInfo
+}
+
+// locate returns the location of the visible version of path
+func (v etcView) locate(relativePath string) string {
+	if v.upper != "" {
+		upperPath := filepath.Join(v.upper, relativePath)
+		info, err := os.Lstat(upperPath)
+		if err == nil && !isWhiteout(info) {
+			return upperPath
+		}
+		if err == nil {
+			return ""
+		}
+	}
+
+	return filepath.Join(v.lower, relativePath)
+}
+
+func (v etcView) readFile(relativePath string) ([]byte, error) {
+	location := v.locate(relativePath)
+	if location == "" {
+		return nil, os.ErrNotExist
+	}
+
+	return os.ReadFile(location)
+}
+
+// walk lists the visible paths of the etc and the whiteouts of the upper without a lower version to hide
+func (v etcView) walk() ([]etcViewEntry, []string, error) {
+	entries := []etcViewEntry{}
+	danglingWhiteouts := []string{}
+
+	// paths of the upper and the ones whose contents in the lower are hidden by them
+	inUpper := make(map[string]bool)
+	hidden := make(map[string]bool)
+
+	if v.upper != "" {
+		upperEntries, err := walkTree(v.upper)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, entry := range upperEntries {
+			if entry.path == "." {
+				continue
+			}
+			inUpper[entry.path] = true
+			hidden[entry.path] = !entry.info.IsDir()
+
+			if !isWhiteout(entry.info) {
+				entries = append(entries, etcViewEntry{path: entry.path, info: entry.info})
+				continue
+			}
+
+			_, err := os.Lstat(filepath.Join(v.lower, entry.path))
+			if errors.Is(err, os.ErrNotExist) {
+				danglingWhiteouts = append(danglingWhiteouts, entry.path)
+			}
+		}
+	}
+
+	lowerEntries, err := walkTree(v.lower)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, entry := range lowerEntries {
+		if entry.path == "." || inUpper[entry.path] {
+			continue
+		}
+		if hidden[filepath.Dir(entry.path)] {
+			hidden[entry.path] = true
+			continue
+		}
+
+		entries = append(entries, etcViewEntry{path: entry.path, info: entry.info})
+	}
+
+	slices.SortFunc(entries, func(a, b etcViewEntry) int {
+		return strings.Compare(a.path, b.path)
+	})
+
+	return entries, danglingWhiteouts, nil
+}
+
+// accountLine is a line of an account file like passwd split into its fields
+type accountLine struct {
+	number int
+	fields []string
+}
+
+// accountEntries is the valid entries of an account file by name
+type accountEntries map[string]accountLine
+
+// parseAccountFile checks the syntax of an account file and returns its valid lines.
+// idFields are the indexes of the fields that have to be numeric ids.
+func parseAccountFile(file string, contents []byte, fieldCount int, idFields []int) (accountEntries, []Finding) {
+	entries := make(accountEntries)
+	findings := []Finding{}
+
+	for i, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		problem := func(severity Severity, format string, args ...any) {
+			message := fmt.Sprintf("line %d: ", i+1) + fmt.Sprintf(format, args...)
+			findings = append(findings, Finding{Severity: severity, Path: file, Message: message})
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) != fieldCount {
+			problem(SeverityError, "has %d fields instead of %d", len(fields), fieldCount)
+			continue
+		}
+		if fields[0] == "" {
+			problem(SeverityError, "has no name")
+			continue
+		}
+
+		validIDs := true
+		for _, field := range idFields {
+			id, err := strconv.Atoi(fields[field])
+			if err != nil || id < 0 {
+				problem(SeverityError, "%s has the invalid id %q", fields[0], fields[field])
+				validIDs = false
+			}
+		}
+		if !validIDs {
+			continue
+		}
+
+		if existing, ok := entries[fields[0]]; ok {
+			problem(SeverityError, "%s is already defined in line %d", fields[0], existing.number)
+			continue
+		}
+
+		entries[fields[0]] = accountLine{number: i + 1, fields: fields}
+	}
+
+	return entries, findings
+}
+
+// ids returns the names of the entries by the numeric id in field
+func (e accountEntries) ids(field int) map[int][]string {
+	ids := make(map[int][]string)
+	for name, line := range e {
+		id, _ := strconv.Atoi(line.fields[field])
+		ids[id] = append(ids[id], name)
+	}
+
+	return ids
+}
+
+// VerifyEtc checks an etc for problems and returns all findings. Upper may be empty
+// to check the lower alone, otherwise the etc overlayfs would show is checked.
+//
+// The account files passwd, group, shadow and gshadow are checked for syntax errors,
+// duplicates and entries missing in the others, the shells of users have to be in the
+// shells file, files have to be owned by existing users and groups, files in ModeRules
+// have to have the expected permissions and whiteouts have to hide something.
+func VerifyEtc(lower, upper string) ([]Finding, error) {
+	view := etcView{lower: lower, upper: upper}
+
+	entries, danglingWhiteouts, err := view.walk()
+	if err != nil {
+		return nil, fmt.Errorf("can't verify etc: %w", err)
+	}
+
+	findings, users, groups, err := verifyAccounts(view)
+	if err != nil {
+		return nil, err
+	}
+
+	shellFindings, err := verifyShells(view, users)
+	if err != nil {
+		return nil, err
+	}
+	findings = append(findings, shellFindings...)
+
+	findings = append(findings, verifyModes(entries)...)
+
+	if users != nil && groups != nil {
+		findings = append(findings, verifyOwners(entries, users.ids(2), groups.ids(2))...)
+	}
+
+	for _, whiteout := range danglingWhiteouts {
+		findings = append(findings, Finding{Severity: SeverityWarning, Path: whiteout, Message: "whiteout doesn't hide anything"})
+	}
+
+	return findings, nil
+}
+
+// verifyAccounts checks the account files, returns the users and groups or nil if their file is missing
+func verifyAccounts(view etcView) ([]Finding, accountEntries, accountEntries, error) {
+	findings := []Finding{}
+	parsed := make(map[string]accountEntries)
+
+	accountFiles := []struct {
+		name       string
+		fieldCount int
+		idFields   []int
+		severity   Severity
+	}{
+		{name: "passwd", fieldCount: 7, idFields: []int{2, 3}, severity: SeverityError},
+		{name: "group", fieldCount: 4, idFields: []int{2}, severity: SeverityError},
+		{name: "shadow", fieldCount: 9, severity: SeverityWarning},
+		{name: "gshadow", fieldCount: 4, severity: SeverityWarning},
+	}
+
+	for _, file := range accountFiles {
+		contents, err := view.readFile(file.name)
+		if errors.Is(err, os.ErrNotExist) {
+			findings = append(findings, Finding{Severity: file.severity, Path: file.name, Message: "doesn't exist"})
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("can't read %s: %w", file.name, err)
+		}
+
+		entries, fileFindings := parseAccountFile(file.name, contents, file.fieldCount, file.idFields)
+		findings = append(findings, fileFindings...)
+		parsed[file.name] = entries
+	}
+
+	users, groups := parsed["passwd"], parsed["group"]
+
+	findings = append(findings, duplicateIDs("passwd", "uid", users)...)
+	findings = append(findings, duplicateIDs("group", "gid", groups)...)
+
+	if users != nil && groups != nil {
+		gids := groups.ids(2)
+		for _, name := range slices.Sorted(maps.Keys(users)) {
+			gid, _ := strconv.Atoi(users[name].fields[3])
+			if _, ok := gids[gid]; !ok {
+				findings = append(findings, Finding{Severity: SeverityWarning, Path: "passwd", Message: fmt.Sprintf("primary group %d of %s doesn't exist", gid, name)})
+			}
+		}
+	}
+
+	findings = append(findings, missingEntries("passwd", users, "shadow", parsed["shadow"])...)
+	findings = append(findings, missingEntries("group", groups, "gshadow", parsed["gshadow"])...)
+
+	return findings, users, groups, nil
+}
+
+func duplicateIDs(file, idName string, entries accountEntries) []Finding {
+	findings := []Finding{}
+
+	ids := entries.ids(2)
+	for _, id := range slices.Sorted(maps.Keys(ids)) {
+		if len(ids[id]) > 1 {
+			names := slices.Sorted(slices.Values(ids[id]))
+			findings = append(findings, Finding{Severity: SeverityWarning, Path: file, Message: fmt.Sprintf("%s %d is used by %s", idName, id, strings.Join(names, ", "))})
+		}
+	}
+
+	return findings
+}
+
+// missingEntries reports entries only one of an account file and its shadow file contain
+func missingEntries(file string, entries accountEntries, shadowFile string, shadowEntries accountEntries) []Finding {
+	findings := []Finding{}
+	if entries == nil || shadowEntries == nil {
+		return findings
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(entries)) {
+		if _, ok := shadowEntries[name]; !ok && entries[name].fields[1] == "x" {
+			findings = append(findings, Finding{Severity: SeverityWarning, Path: shadowFile, Message: fmt.Sprintf("%s of %s is missing", name, file)})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(shadowEntries)) {
+		if _, ok := entries[name]; !ok {
+			findings = append(findings, Finding{Severity: SeverityWarning, Path: shadowFile, Message: fmt.Sprintf("%s doesn't exist in %s", name, file)})
+		}
+	}
+
+	return findings
+}
+
+// verifyShells checks that the login shells of users are listed in the shells file
+func verifyShells(view etcView, users accountEntries) ([]Finding, error) {
+	findings := []Finding{}
+	if users == nil {
+		return findings, nil
+	}
+
+	contents, err := view.readFile("shells")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("can't read shells: %w", err)
+	}
+
+	shells := make(map[string]bool)
+	for _, line := range splitLines(string(contents)) {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			shells[line] = true
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(users)) {
+		shell := users[name].fields[6]
+		if shell == "" || shells[shell] || slices.Contains(NoLoginShells, path.Base(shell)) {
+			continue
+		}
+
+		findings = append(findings, Finding{Severity: SeverityWarning, Path: "passwd", Message: fmt.Sprintf("shell %s of %s isn't listed in shells", shell, name)})
+	}
+
+	return findings, nil
+}
+
+// verifyModes checks the permissions of the files in ModeRules
+func verifyModes(entries []etcViewEntry) []Finding {
+	findings := []Finding{}
+
+	for _, entry := range entries {
+		if !entry.info.Mode().IsRegular() {
+			continue
+		}
+
+		for _, rule := range ModeRules {
+			if !matchesPattern(rule.Pattern, entry.path) {
+				continue
+			}
+
+			mode := entry.info.Mode().Perm()
+			if !slices.Contains(rule.Modes, mode) {
+				expected := []string{}
+				for _, expectedMode := range rule.Modes {
+					expected = append(expected, fmt.Sprintf("%04o", expectedMode))
+				}
+				findings = append(findings, Finding{Severity: SeverityError, Path: entry.path, Message: fmt.Sprintf("has mode %04o instead of %s", mode, strings.Join(expected, " or "))})
+			}
+			break
+		}
+	}
+
+	return findings
+}
+
+// verifyOwners checks that all files are owned by existing users and groups
+func verifyOwners(entries []etcViewEntry, uids, gids map[int][]string) []Finding {
+	findings := []Finding{}
+
+	for _, entry := range entries {
+		stat := entry.info.Sys().(*syscall.Stat_t)
+
+		if _, ok := uids[int(stat.Uid)]; !ok {
+			findings = append(findings, Finding{Severity: SeverityWarning, Path: entry.path, Message: fmt.Sprintf("is owned by uid %d, which no user has", stat.Uid)})
+		}
+		if _, ok := gids[int(stat.Gid)]; !ok {
+			findings = append(findings, Finding{Severity: SeverityWarning, Path: entry.path, Message: fmt.Sprintf("is owned by gid %d, which no group has", stat.Gid)})
+		}
+	}
+
+	return findings
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestVerifyEtc(t *testing.T) {
+	lower := t.TempDir()
+
+	writeFiles(t, map[string]string{
+		filepath.Join(lower, "passwd"):  "root:x:0:0:root:/root:/bin/bash\nnobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin\n",
+		filepath.Join(lower, "group"):   "root:x:0:\nnogroup:x:65534:\n",
+		filepath.Join(lower, "shadow"):  "root:*:20228:0:99999:7:::\nnobody:*:20228:0:99999:7:::\n",
+		filepath.Join(lower, "gshadow"): "root:*::\nnogroup:*::\n",
+		filepath.Join(lower, "shells"):  "# valid login shells\n/bin/bash\n",
+		filepath.Join(lower, "sudoers"): "root ALL=(ALL:ALL) ALL\n",
+	})
+	chmodFiles(t, map[string]os.FileMode{
+		filepath.Join(lower, "shadow"):  0o640,
+		filepath.Join(lower, "gshadow"): 0o000,
+		filepath.Join(lower, "sudoers"): 0o440,
+	})
+
+	findings, err := VerifyEtc(lower, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("valid etc has findings: %v", findings)
+	}
+
+	upper := t.TempDir()
+
+	writeFiles(t, map[string]string{
+		filepath.Join(upper, "passwd"):         "root:x:0:0:root:/root:/bin/bash\nnobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin\ntest:x:1000:1000::/home/test:/bin/zsh\nbroken:x:1001\nroot:x:0:0::/root:/bin/sh\ntoor:*:0:0::/root:/usr/sbin/nologin\n",
+		filepath.Join(upper, "sudoers.d/test"): "test ALL=(ALL) ALL\n",
+		filepath.Join(upper, "owned"):          "",
+	})
+
+	err = os.Chmod(filepath.Join(lower, "shadow"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chown(filepath.Join(upper, "owned"), 4242, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Mknod(filepath.Join(upper, "gone"), syscall.S_IFCHR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hides the lower shells, so no shell is valid anymore
+	err = syscall.Mknod(filepath.Join(upper, "shells"), syscall.S_IFCHR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	findings, err = VerifyEtc(lower, upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Finding{
+		{Severity: SeverityError, Path: "passwd", Message: "line 4: has 3 fields instead of 7"},
+		{Severity: SeverityError, Path: "passwd", Message: "line 5: root is already defined in line 1"},
+		{Severity: SeverityWarning, Path: "passwd", Message: "uid 0 is used by root, toor"},
+		{Severity: SeverityWarning, Path: "passwd", Message: "primary group 1000 of test doesn't exist"},
+		{Severity: SeverityWarning, Path: "shadow", Message: "test of passwd is missing"},
+		{Severity: SeverityWarning, Path: "passwd", Message: "shell /bin/bash of root isn't listed in shells"},
+		{Severity: SeverityWarning, Path: "passwd", Message: "shell /bin/zsh of test isn't listed in shells"},
+		{Severity: SeverityError, Path: "shadow", Message: "has mode 0644 instead of 0640 or 0000"},
+		{Severity: SeverityError, Path: "sudoers.d/test", Message: "has mode 0644 instead of 0440"},
+		{Severity: SeverityWarning, Path: "owned", Message: "is owned by uid 4242, which no user has"},
+		{Severity: SeverityWarning, Path: "gone", Message: "whiteout doesn't hide anything"},
+	}
+
+	for _, finding := range expected {
+		found := false
+		for _, actual := range findings {
+			found = found || actual == finding
+		}
+		if !found {
+			t.Errorf("%s wasn't found", finding)
+		}
+	}
+	if len(findings) != len(expected) {
+		t.Errorf("%d findings instead of %d:\n%s", len(findings), len(expected), joinFindings(findings))
+	}
+}
+
+func joinFindings(findings []Finding) string {
+	lines := []string{}
+	for _, finding := range findings {
+		lines = append(lines, finding.String())
+	}
+
+	return strings.Join(lines, "\n")
+}